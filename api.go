@@ -0,0 +1,364 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rspier/go-ecobee/ecobee"
+)
+
+const (
+	thermostatAPIURL        = "https://api.ecobee.com/1/thermostat"
+	thermostatSummaryAPIURL = "https://api.ecobee.com/1/thermostatSummary"
+)
+
+// thermostat extends ecobee.Thermostat with objects from the API that the
+// ecobee package doesn't decode.
+type thermostat struct {
+	ecobee.Thermostat
+
+	Location             location             `json:"location"`
+	Settings             settings             `json:"settings"`
+	NotificationSettings notificationSettings `json:"notificationSettings"`
+
+	// sections holds the names of the objects present in the response, since
+	// a missing object can't be told apart from one with zero values after
+	// decoding.
+	sections map[string]bool
+}
+
+func (t *thermostat) UnmarshalJSON(b []byte) error {
+	type plain thermostat
+	if err := json.Unmarshal(b, (*plain)(t)); err != nil {
+		return err
+	}
+
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(b, &raw); err != nil {
+		return err
+	}
+	t.sections = make(map[string]bool, len(raw))
+	for name, v := range raw {
+		if string(v) != "null" {
+			t.sections[name] = true
+		}
+	}
+	return nil
+}
+
+// has returns true if the API response included the object named section
+// (e.g., "runtime" or "weather").
+func (t *thermostat) has(section string) bool {
+	return t.sections[section]
+}
+
+// location is the ecobee Location object:
+// https://www.ecobee.com/home/developer/api/documentation/v1/objects/Location.shtml
+type location struct {
+	TimeZone      string `json:"timeZone"`
+	City          string `json:"city"`
+	ProvinceState string `json:"provinceState"`
+	Country       string `json:"country"`
+
+	// MapCoordinates is the latitude and longitude of the thermostat,
+	// separated by a comma (e.g., "43.653226, -79.383184").
+	MapCoordinates string `json:"mapCoordinates"`
+}
+
+// coordinates parses the latitude and longitude from MapCoordinates. ok is
+// false if they're missing or malformed.
+func (l location) coordinates() (lat, long float64, ok bool) {
+	parts := strings.Split(l.MapCoordinates, ",")
+	if len(parts) != 2 {
+		return 0, 0, false
+	}
+	lat, latErr := strconv.ParseFloat(strings.TrimSpace(parts[0]), 64)
+	long, longErr := strconv.ParseFloat(strings.TrimSpace(parts[1]), 64)
+	if latErr != nil || longErr != nil {
+		return 0, 0, false
+	}
+	return lat, long, true
+}
+
+// settings is the ecobee Settings object:
+// https://www.ecobee.com/home/developer/api/documentation/v1/objects/Settings.shtml
+type settings struct {
+	// FanMinOnTime is the minimum number of minutes per hour the fan runs.
+	FanMinOnTime int `json:"fanMinOnTime"`
+	// TempCorrection is the calibration offset applied to the thermostat's
+	// temperature sensor, in tenths of a degree.
+	TempCorrection int `json:"tempCorrection"`
+
+	// Bounds of the allowed heat and cool setpoints, in tenths of a degree.
+	HeatRangeHigh int `json:"heatRangeHigh"`
+	HeatRangeLow  int `json:"heatRangeLow"`
+	CoolRangeHigh int `json:"coolRangeHigh"`
+	CoolRangeLow  int `json:"coolRangeLow"`
+
+	// DehumidifyWithAC is true if the AC may overcool to dehumidify.
+	DehumidifyWithAC bool `json:"dehumidifyWithAC"`
+	// DehumidifyOvercoolOffset is how far below the cool setpoint the AC may
+	// overcool, in tenths of a degree.
+	DehumidifyOvercoolOffset int `json:"dehumidifyOvercoolOffset"`
+
+	// DisablePreHeating and DisablePreCooling are true if Smart Recovery
+	// may not start heating or cooling before a climate change.
+	DisablePreHeating bool `json:"disablePreHeating"`
+	DisablePreCooling bool `json:"disablePreCooling"`
+
+	// HoldAction is how long manual holds last, e.g., nextPeriod or
+	// indefinite.
+	HoldAction string `json:"holdAction"`
+
+	// CompressorProtectionMinTemp is the outdoor temperature below which the
+	// compressor is locked out, in tenths of a degree.
+	CompressorProtectionMinTemp int `json:"compressorProtectionMinTemp"`
+	// AuxMaxOutdoorTemp is the outdoor temperature above which aux heat
+	// isn't used, in tenths of a degree.
+	AuxMaxOutdoorTemp int `json:"auxMaxOutdoorTemp"`
+
+	// FanSpeed is the configured blower speed of systems with a variable
+	// speed fan: low, medium, high, or optimized. It's empty for fans that
+	// only run at a single speed. ecobee doesn't report the blower's actual
+	// speed as a percentage.
+	FanSpeed string `json:"fanSpeed"`
+
+	// VentilatorType is the kind of ventilator installed: none, ventilator,
+	// hrv, or erv.
+	VentilatorType string `json:"ventilatorType"`
+	// VentilatorMinOnTime is the minimum number of minutes per hour the
+	// ventilator runs.
+	VentilatorMinOnTime int `json:"ventilatorMinOnTime"`
+}
+
+// notificationSettings is the ecobee NotificationSettings object:
+// https://www.ecobee.com/home/developer/api/documentation/v1/objects/NotificationSettings.shtml
+type notificationSettings struct {
+	Equipment []equipmentReminder `json:"equipment"`
+}
+
+// equipmentReminder is the ecobee EquipmentSetting object, which configures
+// the maintenance reminder of a piece of equipment.
+type equipmentReminder struct {
+	// Type is the equipment the reminder is for, e.g., furnaceFilter or
+	// hvac.
+	Type    string `json:"type"`
+	Enabled bool   `json:"enabled"`
+
+	// RemindMeDate is the date the next reminder is sent, in the
+	// thermostat's local time.
+	RemindMeDate string `json:"remindMeDate"`
+}
+
+// ecobeeDateLayout is the layout of date strings used by the ecobee API.
+const ecobeeDateLayout = "2006-01-02"
+
+// thermostatSummary extends ecobee.ThermostatSummary with the equipment
+// status as the API reported it.
+type thermostatSummary struct {
+	ecobee.ThermostatSummary
+
+	// RawEquipmentStatus is the comma-separated list of running equipment
+	// (e.g., "heatPump,fan") that EquipmentStatus is parsed from. Equipment
+	// the ecobee package doesn't know about only appears here.
+	RawEquipmentStatus string
+}
+
+// getThermostatSummaries is like (*ecobee.Client).GetThermostatSummary but
+// also keeps the raw equipment status of each thermostat.
+func getThermostatSummaries(ctx context.Context, c *ecobee.Client, s ecobee.Selection) (map[string]thermostatSummary, error) {
+	body, err := apiGet(ctx, c, thermostatSummaryAPIURL, ecobee.GetThermostatSummaryRequest{Selection: s})
+	if err != nil {
+		return nil, fmt.Errorf("error fetching thermostat summary: %w", err)
+	}
+
+	var r ecobee.GetThermostatSummaryResponse
+	if err := json.Unmarshal(body, &r); err != nil {
+		return nil, fmt.Errorf("error unmarshalling json: %w", err)
+	}
+	if r.Status.Code != 0 {
+		return nil, fmt.Errorf("api error %d: %s", r.Status.Code, r.Status.Message)
+	}
+	if len(r.RevisionList) < r.ThermostatCount || len(r.StatusList) < r.ThermostatCount {
+		return nil, fmt.Errorf("summary lists %d thermostats but has %d revisions and %d statuses",
+			r.ThermostatCount, len(r.RevisionList), len(r.StatusList))
+	}
+
+	summaries := make(map[string]thermostatSummary, r.ThermostatCount)
+	for i := 0; i < r.ThermostatCount; i++ {
+		// Each revision is "id:name:connected:thermostat:alerts:runtime:interval".
+		rl := strings.Split(r.RevisionList[i], ":")
+		if len(rl) < 7 {
+			return nil, fmt.Errorf("invalid revision list, not enough fields: %s", r.RevisionList[i])
+		}
+		connected, err := strconv.ParseBool(rl[2])
+		if err != nil {
+			return nil, fmt.Errorf("invalid connected field in revision list: %w", err)
+		}
+
+		// Each status is "id:equipment,equipment,...". The lists are in the same
+		// order.
+		var raw string
+		if parts := strings.SplitN(r.StatusList[i], ":", 2); len(parts) == 2 {
+			raw = parts[1]
+		}
+		var es ecobee.EquipmentStatus
+		if raw != "" {
+			for _, name := range strings.Split(raw, ",") {
+				es.Set(name, true)
+			}
+		}
+
+		summaries[rl[0]] = thermostatSummary{
+			ThermostatSummary: ecobee.ThermostatSummary{
+				Identifier:         rl[0],
+				Name:               rl[1],
+				Connected:          connected,
+				ThermostatRevision: rl[3],
+				AlertsRevision:     rl[4],
+				RuntimeRevision:    rl[5],
+				IntervalRevision:   rl[6],
+				EquipmentStatus:    es,
+			},
+			RawEquipmentStatus: raw,
+		}
+	}
+	return summaries, nil
+}
+
+// getThermostats is like (*ecobee.Client).GetThermostats but decodes the
+// response into the extended thermostat type.
+func getThermostats(ctx context.Context, c *ecobee.Client, s ecobee.Selection) ([]thermostat, error) {
+	body, err := apiGet(ctx, c, thermostatAPIURL, ecobee.GetThermostatsRequest{Selection: s})
+	if err != nil {
+		return nil, fmt.Errorf("error fetching thermostats: %w", err)
+	}
+
+	var r struct {
+		ThermostatList []thermostat  `json:"thermostatList"`
+		Status         ecobee.Status `json:"status"`
+	}
+	if err := json.Unmarshal(body, &r); err != nil {
+		return nil, fmt.Errorf("error unmarshalling json: %w", err)
+	}
+	if r.Status.Code != 0 {
+		return nil, fmt.Errorf("api error %d: %s", r.Status.Code, r.Status.Message)
+	}
+	return r.ThermostatList, nil
+}
+
+// apiGet sends req as the json query parameter of a GET request to endpoint
+// and returns the response body.
+func apiGet(ctx context.Context, c *ecobee.Client, endpoint string, req interface{}) ([]byte, error) {
+	j, err := json.Marshal(req)
+	if err != nil {
+		return nil, fmt.Errorf("error marshaling json: %w", err)
+	}
+
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint+"?json="+url.QueryEscape(string(j)), nil)
+	if err != nil {
+		return nil, fmt.Errorf("could not create request: %w", err)
+	}
+	resp, err := c.Do(httpReq)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("invalid server response: %s", resp.Status)
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("error reading body: %w", err)
+	}
+	return body, nil
+}
+
+// updateThermostat sends req to the thermostat endpoint and returns the
+// status ecobee responded with. Fails if the status isn't successful.
+func updateThermostat(ctx context.Context, c *ecobee.Client, req ecobee.UpdateThermostatRequest) (ecobee.Status, error) {
+	j, err := json.Marshal(req)
+	if err != nil {
+		return ecobee.Status{}, fmt.Errorf("error marshaling json: %w", err)
+	}
+
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, thermostatAPIURL, bytes.NewReader(j))
+	if err != nil {
+		return ecobee.Status{}, fmt.Errorf("could not create request: %w", err)
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	resp, err := c.Do(httpReq)
+	if err != nil {
+		return ecobee.Status{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return ecobee.Status{}, fmt.Errorf("invalid server response: %s", resp.Status)
+	}
+
+	var r ecobee.UpdateThermostatResponse
+	if err := json.NewDecoder(resp.Body).Decode(&r); err != nil {
+		return ecobee.Status{}, fmt.Errorf("error unmarshalling json: %w", err)
+	}
+	if r.Status.Code != 0 {
+		return r.Status, fmt.Errorf("API error %d: %s", r.Status.Code, r.Status.Message)
+	}
+	return r.Status, nil
+}
+
+// clientWithContext returns a copy of c where every request is bound to ctx.
+// This allows cancelling calls made by the ecobee package, which doesn't
+// accept a context.
+func clientWithContext(ctx context.Context, c *ecobee.Client) *ecobee.Client {
+	hc := *c.Client
+	base := hc.Transport
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	hc.Transport = &contextTransport{ctx: ctx, base: base}
+	return &ecobee.Client{Client: &hc}
+}
+
+type contextTransport struct {
+	ctx  context.Context
+	base http.RoundTripper
+}
+
+func (t *contextTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	return t.base.RoundTrip(req.WithContext(t.ctx))
+}
+
+// ecobeeTimeLayout is the layout of date-time strings used by the ecobee
+// API.
+const ecobeeTimeLayout = "2006-01-02 15:04:05"
+
+// timeLocation returns the time zone the thermostat is in. Falls back to UTC
+// if the time zone is unknown.
+func (t *thermostat) timeLocation() *time.Location {
+	if t.Location.TimeZone == "" {
+		return time.UTC
+	}
+	loc, err := time.LoadLocation(t.Location.TimeZone)
+	if err != nil {
+		return time.UTC
+	}
+	return loc
+}
+
+// parseEcobeeTime parses an ecobee date-time string in the given location.
+// Returns the zero time if s is empty.
+func parseEcobeeTime(s string, loc *time.Location) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	return time.ParseInLocation(ecobeeTimeLayout, s, loc)
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/rspier/go-ecobee/ecobee"
+)
+
+// Metric groups that can be toggled with -collectors.
+const (
+	collectorTemperature = "temperature"
+	collectorHumidity    = "humidity"
+	collectorWeather     = "weather"
+	collectorSensors     = "sensors"
+	collectorEquipment   = "equipment"
+	collectorRuntime     = "runtime"
+	collectorProgram     = "program"
+
+	// Groups that need extra data from the API and so aren't enabled by
+	// default.
+	collectorSettings        = "settings"
+	collectorExtendedRuntime = "extended_runtime"
+
+	// Location isn't enabled by default since not everyone wants where their
+	// thermostat is stored alongside its metrics.
+	collectorLocation = "location"
+
+	// Notifications holds maintenance reminders like filter changes, which
+	// are mostly of interest when auditing many thermostats.
+	collectorNotifications = "notifications"
+)
+
+// defaultCollectors is the default value of -collectors.
+var defaultCollectors = strings.Join([]string{
+	collectorTemperature,
+	collectorHumidity,
+	collectorWeather,
+	collectorSensors,
+	collectorEquipment,
+	collectorRuntime,
+	collectorProgram,
+}, ",")
+
+// collectorSet is the set of enabled metric groups.
+type collectorSet map[string]bool
+
+// parseCollectors parses a comma-separated list of metric groups.
+func parseCollectors(s string) (collectorSet, error) {
+	known := collectorSet{
+		collectorSettings:        true,
+		collectorExtendedRuntime: true,
+		collectorLocation:        true,
+		collectorNotifications:   true,
+	}
+	for _, c := range strings.Split(defaultCollectors, ",") {
+		known[c] = true
+	}
+
+	set := collectorSet{}
+	for _, c := range strings.Split(s, ",") {
+		c = strings.TrimSpace(c)
+		if c == "" {
+			continue
+		}
+		if !known[c] {
+			return nil, fmt.Errorf("unknown collector %q, must be one of %s", c, known)
+		}
+		set[c] = true
+	}
+	return set, nil
+}
+
+// String returns the enabled groups as a sorted, comma-separated list.
+func (cs collectorSet) String() string {
+	names := make([]string, 0, len(cs))
+	for c := range cs {
+		names = append(names, c)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ",")
+}
+
+// applySelection sets the Include flags of s needed by the enabled groups.
+// Runtime is always included since it is used to detect when the
+// thermostat has changed.
+func (cs collectorSet) applySelection(s *ecobee.Selection) {
+	s.IncludeRuntime = true
+	// The location holds the time zone used to parse local timestamps.
+	s.IncludeLocation = cs[collectorRuntime] || cs[collectorWeather] || cs[collectorLocation] || cs[collectorNotifications]
+	s.IncludeWeather = cs[collectorWeather]
+	s.IncludeSensors = cs[collectorSensors]
+	s.IncludeProgram = cs[collectorProgram]
+	s.IncludeEvents = cs[collectorProgram]
+	s.IncludeSettings = cs[collectorSettings]
+	s.IncludeExtendedRuntime = cs[collectorExtendedRuntime]
+	s.IncludeNotificationSettings = cs[collectorNotifications]
+}
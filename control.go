@@ -0,0 +1,297 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gorilla/mux"
+	"github.com/rspier/go-ecobee/ecobee"
+)
+
+// registerControlRoutes adds the /control endpoints that modify the
+// thermostats scraped by exporters to r. Every request must carry an
+// Authorization header with a Bearer token matching authToken.
+//
+// The thermostat to modify is chosen with the thermostat_id query
+// parameter, which may be omitted when only one thermostat is scraped.
+func registerControlRoutes(r *mux.Router, cli *ecobee.Client, exporters *exporterSet, authToken string) {
+	cr := r.PathPrefix("/control").Subrouter()
+	cr.Use(requireBearer(authToken))
+
+	// /control/fan runs the fan or returns it to auto for a duration. The body
+	// is a JSON object with a "mode" of "on" or "auto" and an optional
+	// "duration" (e.g., "1h"). Without a duration the hold lasts until the next
+	// schedule transition.
+	cr.HandleFunc("/fan", func(rw http.ResponseWriter, r *http.Request) {
+		e, err := exporters.fromRequest(r)
+		if err != nil {
+			http.Error(rw, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		var req struct {
+			Mode     string `json:"mode"`
+			Duration string `json:"duration"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(rw, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if req.Mode != "on" && req.Mode != "auto" {
+			http.Error(rw, `mode must be "on" or "auto"`, http.StatusBadRequest)
+			return
+		}
+
+		var dur time.Duration
+		if req.Duration != "" {
+			dur, err = time.ParseDuration(req.Duration)
+			if err != nil {
+				http.Error(rw, fmt.Sprintf("invalid duration: %s", err), http.StatusBadRequest)
+				return
+			}
+			if dur <= 0 {
+				http.Error(rw, "duration must be positive", http.StatusBadRequest)
+				return
+			}
+		}
+
+		var end time.Time
+		if dur > 0 {
+			loc, ok := e.TimeLocation()
+			if !ok {
+				http.Error(rw, "thermostat has not been scraped yet", http.StatusServiceUnavailable)
+				return
+			}
+			end = time.Now().Add(dur).In(loc)
+		}
+
+		status, err := setFanHold(r.Context(), cli, e.ThermostatID(), req.Mode, end)
+		if err != nil {
+			http.Error(rw, err.Error(), http.StatusBadGateway)
+			return
+		}
+		writeControlResponse(rw, req, status)
+	}).Methods(http.MethodPost)
+
+	// /control/message displays a message on the thermostat's screen. The body
+	// is a JSON object with the "text" to display.
+	cr.HandleFunc("/message", func(rw http.ResponseWriter, r *http.Request) {
+		e, err := exporters.fromRequest(r)
+		if err != nil {
+			http.Error(rw, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		var req struct {
+			Text string `json:"text"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(rw, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if strings.TrimSpace(req.Text) == "" {
+			http.Error(rw, "text must not be empty", http.StatusBadRequest)
+			return
+		}
+		if n := utf8.RuneCountInString(req.Text); n > maxMessageLength {
+			http.Error(rw, fmt.Sprintf("text is %d characters, maximum is %d", n, maxMessageLength), http.StatusBadRequest)
+			return
+		}
+
+		status, err := sendMessage(r.Context(), cli, e.ThermostatID(), req.Text)
+		if err != nil {
+			http.Error(rw, err.Error(), http.StatusBadGateway)
+			return
+		}
+		writeControlResponse(rw, req, status)
+	}).Methods(http.MethodPost)
+
+	// /control/nudge holds the heat and cool setpoints a number of degrees away
+	// from the current ones until the next schedule transition. The body is a
+	// JSON object with "deltaF", the degrees Fahrenheit to add to both
+	// setpoints; negative values make it cooler. The current setpoints come
+	// from the most recent scrape. The new setpoints are checked against the
+	// thermostat's heat and cool ranges when the settings collector is enabled.
+	cr.HandleFunc("/nudge", func(rw http.ResponseWriter, r *http.Request) {
+		e, err := exporters.fromRequest(r)
+		if err != nil {
+			http.Error(rw, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		var req struct {
+			DeltaF float64 `json:"deltaF"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(rw, err.Error(), http.StatusBadRequest)
+			return
+		}
+		// ecobee setpoints are in tenths of a degree Fahrenheit.
+		delta := int(math.Round(req.DeltaF * 10))
+		if delta == 0 {
+			http.Error(rw, "deltaF must not be zero", http.StatusBadRequest)
+			return
+		}
+
+		sp, ok := e.Setpoints()
+		if !ok {
+			http.Error(rw, "thermostat has not been scraped yet", http.StatusServiceUnavailable)
+			return
+		}
+		heat, cool := sp.DesiredHeat+delta, sp.DesiredCool+delta
+		if err := checkRange("heat", heat, sp.HeatRangeLow, sp.HeatRangeHigh); err != nil {
+			http.Error(rw, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := checkRange("cool", cool, sp.CoolRangeLow, sp.CoolRangeHigh); err != nil {
+			http.Error(rw, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		status, err := setTemperatureHold(r.Context(), cli, e.ThermostatID(), heat, cool)
+		if err != nil {
+			http.Error(rw, err.Error(), http.StatusBadGateway)
+			return
+		}
+		writeControlResponse(rw, struct {
+			DeltaF      float64 `json:"deltaF"`
+			DesiredHeat float64 `json:"desiredHeat"`
+			DesiredCool float64 `json:"desiredCool"`
+		}{
+			DeltaF:      float64(delta) / 10,
+			DesiredHeat: float64(heat) / 10,
+			DesiredCool: float64(cool) / 10,
+		}, status)
+	}).Methods(http.MethodPost)
+}
+
+// checkRange returns an error if the setpoint v is outside of [low, high].
+// All values are in tenths of a degree Fahrenheit. A range of zero is
+// unknown and isn't checked.
+func checkRange(name string, v, low, high int) error {
+	if low == 0 && high == 0 {
+		return nil
+	}
+	if v < low || v > high {
+		return fmt.Errorf("%s setpoint %.1f°F is outside of the allowed range %.1f°F to %.1f°F",
+			name, float64(v)/10, float64(low)/10, float64(high)/10)
+	}
+	return nil
+}
+
+// maxMessageLength is the longest message the ecobee sendMessage function
+// accepts.
+const maxMessageLength = 500
+
+// requireBearer returns middleware that rejects requests whose Authorization
+// header doesn't hold token as a Bearer token.
+func requireBearer(token string) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			authHeader := r.Header.Get("Authorization")
+			if !strings.HasPrefix(authHeader, "Bearer ") {
+				http.Error(rw, "not authorized", http.StatusUnauthorized)
+				return
+			}
+			given := strings.TrimPrefix(authHeader, "Bearer ")
+			if subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+				http.Error(rw, "not authorized", http.StatusUnauthorized)
+				return
+			}
+			next.ServeHTTP(rw, r)
+		})
+	}
+}
+
+// writeControlResponse reports a successful thermostat update with the
+// status ecobee responded with and what was applied.
+func writeControlResponse(rw http.ResponseWriter, applied interface{}, status ecobee.Status) {
+	rw.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(rw).Encode(struct {
+		Status  ecobee.Status `json:"status"`
+		Applied interface{}   `json:"applied"`
+	}{
+		Status:  status,
+		Applied: applied,
+	})
+}
+
+// setFanHold sets a hold on the thermostat that only changes the fan mode
+// until end, which must be in the thermostat's time zone since ecobee reads
+// it as the thermostat's local time. A zero end holds until the next
+// schedule transition.
+func setFanHold(ctx context.Context, c *ecobee.Client, thermostatID string, mode string, end time.Time) (ecobee.Status, error) {
+	shp := ecobee.SetHoldParams{
+		// These hold temps aren't used because neither IsTemperature flag is set.
+		CoolHoldTemp: 800,
+		HeatHoldTemp: 690,
+		HoldType:     "nextTransition",
+		Event: ecobee.Event{
+			Fan:                   mode,
+			IsTemperatureRelative: false,
+			IsTemperatureAbsolute: false,
+		},
+	}
+	if !end.IsZero() {
+		shp.HoldType = "dateTime"
+		shp.EndDate = end.Format("2006-01-02")
+		shp.EndTime = end.Format("15:04:05")
+	}
+
+	return setHold(ctx, c, thermostatID, shp)
+}
+
+// setTemperatureHold sets a hold on the thermostat at the heat and cool
+// setpoints, in tenths of a degree Fahrenheit, until the next schedule
+// transition.
+func setTemperatureHold(ctx context.Context, c *ecobee.Client, thermostatID string, heat, cool int) (ecobee.Status, error) {
+	return setHold(ctx, c, thermostatID, ecobee.SetHoldParams{
+		CoolHoldTemp: cool,
+		HeatHoldTemp: heat,
+		HoldType:     "nextTransition",
+		Event: ecobee.Event{
+			Fan:                   "auto",
+			IsTemperatureRelative: false,
+			IsTemperatureAbsolute: true,
+		},
+	})
+}
+
+// setHold calls the setHold function on the thermostat.
+func setHold(ctx context.Context, c *ecobee.Client, thermostatID string, shp ecobee.SetHoldParams) (ecobee.Status, error) {
+	return callFunction(ctx, c, thermostatID, ecobee.Function{Type: "setHold", Params: shp})
+}
+
+// sendMessage calls the sendMessage function to display text on the
+// thermostat.
+func sendMessage(ctx context.Context, c *ecobee.Client, thermostatID string, text string) (ecobee.Status, error) {
+	return callFunction(ctx, c, thermostatID, ecobee.Function{
+		Type: "sendMessage",
+		Params: ecobee.SendMessageParams{
+			Alert: ecobee.Alert{
+				AlertType:       "message",
+				IsOperatorAlert: true,
+			},
+			Text: text,
+		},
+	})
+}
+
+// callFunction calls fn on the thermostat and returns the status ecobee
+// responded with.
+func callFunction(ctx context.Context, c *ecobee.Client, thermostatID string, fn ecobee.Function) (ecobee.Status, error) {
+	return updateThermostat(ctx, c, ecobee.UpdateThermostatRequest{
+		Selection: ecobee.Selection{
+			SelectionType:  "thermostats",
+			SelectionMatch: thermostatID,
+		},
+		Functions: []ecobee.Function{fn},
+	})
+}
@@ -8,10 +8,11 @@ package ecobeeauth
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"log"
 	"net/http"
 	"net/url"
-	"os"
 	"strings"
 	"sync"
 	"time"
@@ -22,43 +23,110 @@ import (
 // This file contains authentication related functions and structs.
 var Scopes = []string{"smartRead", "smartWrite"}
 
+// Endpoint is the default ecobee authorization and token endpoint.
+var Endpoint = oauth2.Endpoint{
+	AuthURL:  "https://api.ecobee.com/authorize",
+	TokenURL: "https://api.ecobee.com/token",
+}
+
+// Option configures a TokenSource.
+type Option func(*TokenSource)
+
+// WithEndpoint overrides the URLs used for the pin authorization flow and
+// for retrieving tokens. The default is Endpoint.
+func WithEndpoint(ep oauth2.Endpoint) Option {
+	return func(ts *TokenSource) {
+		ts.endpoint = ep
+	}
+}
+
+// WithExpirySkew sets how much earlier than ecobee reports a new token
+// expires it is treated as expired. Widening the skew makes refreshes happen
+// sooner on slow networks or hosts with unreliable clocks. The default is
+// one second.
+func WithExpirySkew(d time.Duration) Option {
+	return func(ts *TokenSource) {
+		ts.expirySkew = d
+	}
+}
+
+// WithMaxResponseSize sets the largest response body, in bytes, that is
+// read from the ecobee authorization endpoints. The default is
+// DefaultMaxResponseSize.
+func WithMaxResponseSize(n int64) Option {
+	return func(ts *TokenSource) {
+		ts.maxResponseSize = n
+	}
+}
+
+// WithRequiredScopes sets the scopes the exporter needs the token to have
+// been granted (e.g., smartWrite to modify the thermostat). A warning is
+// logged if the token loaded by NewTokenSource doesn't cover them. By
+// default, no scopes are required.
+func WithRequiredScopes(scopes ...string) Option {
+	return func(ts *TokenSource) {
+		ts.requiredScopes = scopes
+	}
+}
+
+// defaultExpirySkew is the default value of WithExpirySkew.
+const defaultExpirySkew = time.Second
+
 type TokenSource struct {
-	clientID string
+	clientID        string
+	endpoint        oauth2.Endpoint
+	expirySkew      time.Duration
+	maxResponseSize int64
+	requiredScopes  []string
 
-	mut       sync.Mutex
-	tok       *oauth2.Token
-	cacheFile string
+	mut            sync.Mutex
+	tok            *oauth2.Token
+	store          TokenStore
+	reAuthRequired bool
+	lastErrReason  string
+	refreshFails   uint64
+	refreshSkipped uint64
+	loadErrors     uint64
 }
 
 // NewTokenSource creates a new TokenSource that can authenticate against the
-// ecobee API and cache the resulting token to a file.
+// ecobee API and persist the resulting token to a TokenStore.
 //
-// If the provided cacheFile does not already contain a token, retrieving the
+// If the provided store does not already contain a token, retrieving the
 // Token from the TokenSource will fail. Call GetPin to get a temporary pin
 // and authenticate the application in the Ecobee consumer portal. Afterwards,
 // call GetToken with the code provided in the GetPin response.
 //
-// Using cacheFile is optional.
-func NewTokenSource(clientID string, cacheFile string) (*TokenSource, error) {
+// Using store is optional.
+func NewTokenSource(ctx context.Context, clientID string, store TokenStore, opts ...Option) (*TokenSource, error) {
 	ts := TokenSource{
-		clientID:  clientID,
-		cacheFile: cacheFile,
-	}
-	if cacheFile != "" {
-		var tok oauth2.Token
-		f, err := os.Open(cacheFile)
-		if os.IsNotExist(err) {
-			return &ts, nil
+		clientID:        clientID,
+		endpoint:        Endpoint,
+		expirySkew:      defaultExpirySkew,
+		maxResponseSize: DefaultMaxResponseSize,
+		store:           store,
+	}
+	for _, opt := range opts {
+		opt(&ts)
+	}
+	if store != nil {
+		tok, err := store.Load(ctx)
+		if errors.Is(err, ErrCorruptToken) {
+			// A corrupt token can only be fixed by authenticating again, so
+			// continue without a token.
+			log.Println("ignoring cached token, re-authorization required:", err)
+			ts.loadErrors++
 		} else if err != nil {
 			// Return error back to the client because the problem probably can't be
 			// resolved on its own.
 			return nil, err
 		}
-		defer f.Close()
-
-		if err := json.NewDecoder(f).Decode(&tok); err == nil {
-			// Only set the token if decoding didn't fail.
-			ts.tok = &tok
+		ts.tok = tok
+	}
+	if ts.tok != nil {
+		if missing := ts.MissingScopes(); len(missing) > 0 {
+			log.Printf("cached token was granted scopes %q but %q are required, authorize again to grant them",
+				strings.Join(TokenScopes(ts.tok), ","), strings.Join(missing, ","))
 		}
 	}
 
@@ -66,31 +134,102 @@ func NewTokenSource(clientID string, cacheFile string) (*TokenSource, error) {
 }
 
 // Token returns the current saved token. To save a token, call SaveToken.
-// If no token is saved, an error will be returned.
+// If no token is saved, ErrNoToken will be returned.
 //
-// If the saved token is expired, it will be refreshed and then saved.
+// If the saved token is expired, it will be refreshed and then saved. The
+// refresh is given 5 seconds to complete; use TokenWithContext to control
+// the deadline.
 func (ts *TokenSource) Token() (*oauth2.Token, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	return ts.TokenWithContext(ctx)
+}
+
+// TokenWithContext is like Token, but refreshing an expired token is
+// abandoned once ctx is canceled.
+func (ts *TokenSource) TokenWithContext(ctx context.Context) (*oauth2.Token, error) {
 	ts.mut.Lock()
 	defer ts.mut.Unlock()
 
 	if ts.tok == nil {
-		return nil, fmt.Errorf("token not yet available")
+		return nil, ErrNoToken
 	}
 
 	if !ts.tok.Valid() {
 		// Try to refresh the token.
-		ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
-		defer cancel()
-		newTok, err := ts.RefreshToken(ctx, ts.tok)
+		if err := ts.refresh(ctx); err != nil {
+			return nil, err
+		}
+	}
+
+	return ts.tok, nil
+}
+
+// refresh refreshes and saves the current token. ts.mut must be held.
+//
+// If the store is shared with other processes, the store is locked while
+// refreshing. If another process already refreshed the token, the refreshed
+// token is loaded from the store instead.
+func (ts *TokenSource) refresh(ctx context.Context) error {
+	if l, ok := ts.store.(Locker); ok {
+		unlock, err := l.Lock(ctx)
+		if err != nil {
+			ts.refreshFails++
+			ts.lastErrReason = ReasonTokenStore
+			return fmt.Errorf("could not lock token store: %w", err)
+		}
+		defer unlock()
+	}
+
+	if ts.store != nil {
+		stored, err := ts.store.Load(ctx)
 		if err != nil {
-			return nil, fmt.Errorf("could not refresh token: %w", err)
+			ts.loadErrors++
+		} else if stored != nil && stored.AccessToken != ts.tok.AccessToken && stored.Valid() {
+			ts.tok = stored
+			ts.reAuthRequired = false
+			ts.lastErrReason = ""
+			ts.refreshSkipped++
+			return nil
 		}
+	}
 
-		// Ignore the error here, which would be from caching.
-		_ = ts.saveToken(newTok)
+	newTok, err := ts.RefreshToken(ctx, ts.tok)
+	if err != nil {
+		ts.refreshFails++
+		ts.reAuthRequired = errors.Is(err, ErrReAuthRequired)
+		ts.lastErrReason = ErrorReason(err)
+		return fmt.Errorf("could not refresh token: %w", err)
 	}
 
-	return ts.tok, nil
+	// Ignore the error here, which would be from caching.
+	_ = ts.saveToken(newTok)
+	return nil
+}
+
+// Reload replaces the current token with the one in the TokenStore, if the
+// store has one. This picks up a token written to the store by another
+// process.
+func (ts *TokenSource) Reload(ctx context.Context) error {
+	if ts.store == nil {
+		return nil
+	}
+	tok, err := ts.store.Load(ctx)
+	if err != nil {
+		ts.mut.Lock()
+		ts.loadErrors++
+		ts.mut.Unlock()
+		return err
+	} else if tok == nil {
+		return nil
+	}
+
+	ts.mut.Lock()
+	defer ts.mut.Unlock()
+	ts.tok = tok
+	ts.reAuthRequired = false
+	ts.lastErrReason = ""
+	return nil
 }
 
 // SaveToken saves and caches the given token.
@@ -100,19 +239,79 @@ func (ts *TokenSource) SaveToken(tok *oauth2.Token) error {
 	return ts.saveToken(tok)
 }
 
+// CachedToken returns the current saved token without attempting to refresh
+// it. Returns nil if no token is saved.
+func (ts *TokenSource) CachedToken() *oauth2.Token {
+	ts.mut.Lock()
+	defer ts.mut.Unlock()
+	return ts.tok
+}
+
+// RefreshFailures returns the number of times refreshing the token has
+// failed.
+func (ts *TokenSource) RefreshFailures() uint64 {
+	ts.mut.Lock()
+	defer ts.mut.Unlock()
+	return ts.refreshFails
+}
+
+// RefreshSkipped returns the number of times a refresh was skipped because
+// another process sharing the TokenStore already refreshed the token.
+func (ts *TokenSource) RefreshSkipped() uint64 {
+	ts.mut.Lock()
+	defer ts.mut.Unlock()
+	return ts.refreshSkipped
+}
+
+// LoadErrors returns the number of times the token couldn't be loaded from
+// the TokenStore.
+func (ts *TokenSource) LoadErrors() uint64 {
+	ts.mut.Lock()
+	defer ts.mut.Unlock()
+	return ts.loadErrors
+}
+
+// ReAuthRequired returns true if the last refresh attempt was rejected by
+// ecobee with ErrReAuthRequired. It is reset once a new token is saved.
+func (ts *TokenSource) ReAuthRequired() bool {
+	ts.mut.Lock()
+	defer ts.mut.Unlock()
+	return ts.reAuthRequired
+}
+
+// MissingScopes returns the scopes set by WithRequiredScopes that the
+// current token wasn't granted. It is empty if there is no token or its
+// scopes aren't known.
+func (ts *TokenSource) MissingScopes() []string {
+	tok := ts.CachedToken()
+	if tok == nil {
+		return nil
+	}
+	granted := TokenScopes(tok)
+	if len(granted) == 0 {
+		return nil
+	}
+	return MissingScopes(granted, ts.requiredScopes)
+}
+
+// LastErrorReason returns the ErrorReason of the last failure to refresh
+// the token or to complete the pin authorization flow. It is empty if there
+// hasn't been a failure since a token was last saved or loaded.
+func (ts *TokenSource) LastErrorReason() string {
+	ts.mut.Lock()
+	defer ts.mut.Unlock()
+	return ts.lastErrReason
+}
+
 func (ts *TokenSource) saveToken(tok *oauth2.Token) error {
 	ts.tok = tok
+	ts.reAuthRequired = false
+	ts.lastErrReason = ""
 
-	if ts.cacheFile != "" {
-		f, err := os.OpenFile(ts.cacheFile, os.O_CREATE|os.O_TRUNC|os.O_RDWR, 0660)
-		if err != nil {
-			return fmt.Errorf("failed to cache file: %w", err)
-		}
-		defer f.Close()
-
-		if err := json.NewEncoder(f).Encode(ts.tok); err != nil {
-			return fmt.Errorf("failed to encode token: %w", err)
-		}
+	if ts.store != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+		defer cancel()
+		return ts.store.Save(ctx, tok)
 	}
 
 	return nil
@@ -125,25 +324,27 @@ func (ts *TokenSource) GetPin(ctx context.Context) (*PinResponse, error) {
 		"client_id":     {ts.clientID},
 		"scope":         {strings.Join(Scopes, ",")},
 	}
-	u := url.URL{
-		Scheme:   "https",
-		Host:     "api.ecobee.com",
-		Path:     "authorize",
-		RawQuery: uv.Encode(),
-	}
-
-	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	u, err := url.Parse(ts.endpoint.AuthURL)
 	if err != nil {
-		return nil, fmt.Errorf("could not create request: %w", err)
+		return nil, fmt.Errorf("invalid auth URL: %w", err)
 	}
-	resp, err := http.DefaultClient.Do(req)
+	u.RawQuery = uv.Encode()
+
+	resp, err := doWithRetry(ctx, func() (*http.Request, error) {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+		if err != nil {
+			return nil, fmt.Errorf("could not create request: %w", err)
+		}
+		return req, nil
+	})
 	if err != nil {
 		return nil, fmt.Errorf("error retrieving response: %w", err)
 	}
 	defer resp.Body.Close()
+	resp.Body = LimitBody(resp.Body, ts.maxResponseSize)
 
 	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("invalid server response: %s", resp.Status)
+		return nil, readAPIError(resp.Status, resp.Body)
 	}
 
 	var pr PinResponse
@@ -153,52 +354,130 @@ func (ts *TokenSource) GetPin(ctx context.Context) (*PinResponse, error) {
 	return &pr, nil
 }
 
-// GetToken gets a token from a Code in a PinResponse. Will fail if the code
-// hasn't been submitted on the Ecobee portal.
+// GetToken gets a token from a Code in a PinResponse. Fails with
+// ErrAuthorizationPending if the pin hasn't been submitted on the Ecobee
+// portal yet, or ErrPinExpired if it can no longer be submitted.
 //
 // To use the token in the TokenSource, call SaveToken.
 func (ts *TokenSource) GetToken(ctx context.Context, code string) (*oauth2.Token, error) {
-	return ts.getToken(ctx, url.Values{
+	tok, err := ts.getToken(ctx, url.Values{
 		"grant_type": {"ecobeePin"},
 		"client_id":  {ts.clientID},
 		"code":       {code},
 	})
+	// A pending authorization is expected while polling for the pin to be
+	// entered, so it isn't a failure.
+	if err != nil && !errors.Is(err, ErrAuthorizationPending) {
+		ts.mut.Lock()
+		ts.lastErrReason = ErrorReason(err)
+		ts.mut.Unlock()
+	}
+	if err != nil {
+		return nil, err
+	}
+	return withObtainedAt(tok, time.Now()), nil
 }
 
-// RefreshToken will refresh the given token, returning a new token.
+// RefreshToken will refresh the given token, returning a new token. Fails
+// with ErrReAuthRequired if ecobee rejects the refresh token.
 //
 // To use the refreshed token in the TokenSource, call SaveToken.
 func (ts *TokenSource) RefreshToken(ctx context.Context, tok *oauth2.Token) (*oauth2.Token, error) {
 	if tok.RefreshToken == "" {
-		return nil, fmt.Errorf("token did not have a refresh")
+		return nil, ErrNoRefreshToken
 	}
-	return ts.getToken(ctx, url.Values{
+	newTok, err := ts.getToken(ctx, url.Values{
 		"grant_type": {"refresh_token"},
 		"client_id":  {ts.clientID},
 		"code":       {tok.RefreshToken},
 	})
+	if err != nil {
+		return nil, err
+	}
+	// The refreshed token belongs to the same authorization.
+	return withObtainedAt(newTok, ObtainedAt(tok)), nil
 }
 
-func (ts *TokenSource) getToken(ctx context.Context, uv url.Values) (*oauth2.Token, error) {
-	u := url.URL{
-		Scheme:   "https",
-		Host:     "api.ecobee.com",
-		Path:     "token",
-		RawQuery: uv.Encode(),
+// scopeKey is the extra field of a token holding the comma-separated scopes
+// it was granted.
+const scopeKey = "scope"
+
+// TokenScopes returns the scopes tok was granted. Returns nil if they
+// aren't known, such as for tokens saved by older versions.
+func TokenScopes(tok *oauth2.Token) []string {
+	s, _ := tok.Extra(scopeKey).(string)
+	if s == "" {
+		return nil
+	}
+	return strings.Split(s, ",")
+}
+
+// MissingScopes returns the scopes in required that aren't covered by
+// granted. smartWrite covers smartRead, since ecobee grants read access
+// along with write access.
+func MissingScopes(granted, required []string) []string {
+	has := make(map[string]bool, len(granted))
+	for _, s := range granted {
+		has[strings.TrimSpace(s)] = true
+	}
+	var missing []string
+	for _, s := range required {
+		if has[s] || (s == "smartRead" && has["smartWrite"]) {
+			continue
+		}
+		missing = append(missing, s)
+	}
+	return missing
+}
+
+// obtainedAtKey is the extra field of a token holding when the pin flow
+// that authorized it completed.
+const obtainedAtKey = "obtained_at"
+
+// ObtainedAt returns when the authorization tok belongs to was obtained
+// through the pin flow. Refreshed tokens keep the time of the original
+// authorization, since ecobee refresh tokens stop working about a year
+// after it. Returns the zero time if it isn't known, such as for tokens
+// saved by older versions.
+func ObtainedAt(tok *oauth2.Token) time.Time {
+	t, _ := tok.Extra(obtainedAtKey).(time.Time)
+	return t
+}
+
+// withObtainedAt returns a copy of tok that was obtained at t. tok is
+// returned unchanged if t is the zero time.
+func withObtainedAt(tok *oauth2.Token, t time.Time) *oauth2.Token {
+	if t.IsZero() {
+		return tok
 	}
+	return tok.WithExtra(map[string]interface{}{
+		scopeKey:      tok.Extra(scopeKey),
+		obtainedAtKey: t,
+	})
+}
 
-	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u.String(), nil)
+func (ts *TokenSource) getToken(ctx context.Context, uv url.Values) (*oauth2.Token, error) {
+	u, err := url.Parse(ts.endpoint.TokenURL)
 	if err != nil {
-		return nil, fmt.Errorf("could not create request: %w", err)
+		return nil, fmt.Errorf("invalid token URL: %w", err)
 	}
-	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
-	resp, err := http.DefaultClient.Do(req)
+	u.RawQuery = uv.Encode()
+
+	resp, err := doWithRetry(ctx, func() (*http.Request, error) {
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, u.String(), nil)
+		if err != nil {
+			return nil, fmt.Errorf("could not create request: %w", err)
+		}
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		return req, nil
+	})
 	if err != nil {
 		return nil, fmt.Errorf("error POSTing request: %w", err)
 	}
 	defer resp.Body.Close()
+	resp.Body = LimitBody(resp.Body, ts.maxResponseSize)
 	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("invalid server response: %s", resp.Status)
+		return nil, readAPIError(resp.Status, resp.Body)
 	}
 
 	var t token
@@ -206,6 +485,9 @@ func (ts *TokenSource) getToken(ctx context.Context, uv url.Values) (*oauth2.Tok
 		return nil, fmt.Errorf("failed to read response: %w", err)
 	}
 	oauthTok := oauth2.Token(t)
+
+	// Underestimate how much time is left instead of overestimating.
+	oauthTok.Expiry = oauthTok.Expiry.Add(-ts.expirySkew)
 	return &oauthTok, nil
 }
 
@@ -225,24 +507,33 @@ func (t *token) UnmarshalJSON(b []byte) error {
 		return err
 	}
 
-	// Subtract a second from the expires in to underestimate how much time is
-	// left instead of overestimating.
+	// The expiry is moved earlier by the TokenSource's expiry skew after
+	// decoding.
 	//
 	// At the time of writing, expires_in is documented (on the Ecobee website) as
 	// representing minutes, but this is not true - it represents seconds.
-	f.Token.Expiry = time.Now().Add(time.Second * time.Duration(f.ExpiresIn-1))
+	f.Token.Expiry = time.Now().Add(time.Second * time.Duration(f.ExpiresIn))
 	*t = token(*f.Token.WithExtra(map[string]interface{}{
-		"scope": f.Scope,
+		scopeKey: f.Scope,
 	}))
 	return nil
 }
 
 // PinResponse is returned by the Ecobee API and holds a pin to enter into
 // the website portal and a code to use once the pin has been verified.
+//
+// https://www.ecobee.com/home/developer/api/documentation/v1/auth/pin-api-authorization.shtml
 type PinResponse struct {
-	EcobeePin      string `json:"ecobeePin"`
-	Code           string `json:"code"`
-	Scope          string `json:"scope"`
-	ExpiresSeconds int    `json:"expires_in"`
-	Interval       int    `json:"interval"`
+	EcobeePin string `json:"ecobeePin"`
+	Code      string `json:"code"`
+	Scope     string `json:"scope"`
+
+	// ExpiresMinutes is the number of minutes until the pin expires. Unlike
+	// the expires_in of a token, which is in seconds, the pin's expires_in
+	// is in minutes.
+	ExpiresMinutes int `json:"expires_in"`
+
+	// Interval is the minimum number of seconds to wait between calls to
+	// GetToken while waiting for the pin to be entered.
+	Interval int `json:"interval"`
 }
@@ -0,0 +1,144 @@
+package ecobeeauth
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+func TestPinResponse_ExpiresInMinutes(t *testing.T) {
+	bb, err := ioutil.ReadFile("testdata/pin_response.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var pr PinResponse
+	if err := json.Unmarshal(bb, &pr); err != nil {
+		t.Fatal(err)
+	}
+
+	if pr.ExpiresMinutes != 9 {
+		t.Errorf("ExpiresMinutes = %d, want 9", pr.ExpiresMinutes)
+	}
+	if pr.EcobeePin != "bv29" {
+		t.Errorf("EcobeePin = %q, want %q", pr.EcobeePin, "bv29")
+	}
+	if pr.Interval != 30 {
+		t.Errorf("Interval = %d, want 30", pr.Interval)
+	}
+}
+
+func TestToken_ExpiresInSeconds(t *testing.T) {
+	bb, err := ioutil.ReadFile("testdata/token_response.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	var tok token
+	if err := json.Unmarshal(bb, &tok); err != nil {
+		t.Fatal(err)
+	}
+
+	// An expires_in of 3599 is just under an hour, not 3599 minutes.
+	want := start.Add(3599 * time.Second)
+	if d := tok.Expiry.Sub(want); d < 0 || d > 5*time.Second {
+		t.Errorf("Expiry = %s, want about %s", tok.Expiry, want)
+	}
+	if tok.RefreshToken != "og2Obost3ucRo1ofo0EDoslGltmFMe2g" {
+		t.Errorf("RefreshToken = %q", tok.RefreshToken)
+	}
+}
+
+func TestTokenSource_SaveTokenRoundTrip(t *testing.T) {
+	store := NewMemoryTokenStore(nil)
+	ts, err := NewTokenSource(context.Background(), "client-id", store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ts.Token(); !errors.Is(err, ErrNoToken) {
+		t.Fatalf("Token() without a saved token returned %v, want ErrNoToken", err)
+	}
+
+	tok := &oauth2.Token{
+		AccessToken:  "access",
+		RefreshToken: "refresh",
+		Expiry:       time.Now().Add(time.Hour),
+	}
+	if err := ts.SaveToken(tok); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := ts.Token()
+	if err != nil {
+		t.Fatal(err)
+	} else if got.AccessToken != "access" {
+		t.Errorf("Token() access token = %q, want %q", got.AccessToken, "access")
+	}
+
+	// A new TokenSource for the same store loads the saved token.
+	reloaded, err := NewTokenSource(context.Background(), "client-id", store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := reloaded.CachedToken(); got == nil || got.AccessToken != "access" {
+		t.Errorf("reloaded token = %v, want access token %q", got, "access")
+	}
+}
+
+func TestTokenSource_RefreshExpired(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		if r.Method != http.MethodPost || q.Get("grant_type") != "refresh_token" || q.Get("code") != "old-refresh" {
+			http.Error(rw, `{"error": "invalid_grant"}`, http.StatusBadRequest)
+			return
+		}
+		rw.Header().Set("Content-Type", "application/json")
+		_, _ = io.WriteString(rw, `{
+			"access_token": "new-access",
+			"token_type": "Bearer",
+			"expires_in": 3599,
+			"refresh_token": "new-refresh",
+			"scope": "smartRead"
+		}`)
+	}))
+	defer srv.Close()
+
+	store := NewMemoryTokenStore(&oauth2.Token{
+		AccessToken:  "old-access",
+		RefreshToken: "old-refresh",
+		Expiry:       time.Now().Add(-time.Minute),
+	})
+	ts, err := NewTokenSource(context.Background(), "client-id", store, WithEndpoint(oauth2.Endpoint{
+		AuthURL:  srv.URL + "/authorize",
+		TokenURL: srv.URL + "/token",
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tok, err := ts.Token()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tok.AccessToken != "new-access" || tok.RefreshToken != "new-refresh" {
+		t.Errorf("Token() = %q/%q, want new-access/new-refresh", tok.AccessToken, tok.RefreshToken)
+	}
+	if !tok.Valid() {
+		t.Error("refreshed token is not valid")
+	}
+
+	// The refreshed token is saved to the store.
+	stored, err := store.Load(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	} else if stored.AccessToken != "new-access" {
+		t.Errorf("stored access token = %q, want new-access", stored.AccessToken)
+	}
+}
@@ -0,0 +1,129 @@
+package ecobeeauth
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+)
+
+// ErrNoToken is returned by TokenSource.Token when no token has been saved
+// yet. The pin authorization flow must be run to obtain one.
+var ErrNoToken = errors.New("token not yet available")
+
+// ErrNoRefreshToken is returned when refreshing a token that doesn't have a
+// refresh token.
+var ErrNoRefreshToken = errors.New("token did not have a refresh token")
+
+// ErrAuthorizationPending is returned by GetToken when the pin hasn't been
+// entered in the ecobee portal yet. The request should be retried after
+// waiting for the interval given in the PinResponse.
+var ErrAuthorizationPending = errors.New("authorization pending, pin not yet entered")
+
+// ErrPinExpired is returned by GetToken when the pin expired before it was
+// entered in the ecobee portal. A new pin must be requested.
+var ErrPinExpired = errors.New("pin expired, request a new pin")
+
+// ErrInvalidClient is returned when ecobee doesn't recognize the API key.
+var ErrInvalidClient = errors.New("invalid api key")
+
+// ErrReAuthRequired is returned when ecobee rejects the refresh token. The
+// pin authorization flow must be run again to obtain a new token.
+var ErrReAuthRequired = errors.New("refresh token rejected, re-authorization required")
+
+// ErrCorruptToken is returned by a TokenStore when the stored token can't be
+// decoded.
+var ErrCorruptToken = errors.New("stored token is corrupt")
+
+// APIError is an error returned in the body of a failed ecobee
+// authorization request:
+// https://www.ecobee.com/home/developer/api/documentation/v1/auth/auth-req-resp.shtml
+type APIError struct {
+	// Status is the HTTP status line of the response.
+	Status string `json:"-"`
+
+	Code        string `json:"error"`
+	Description string `json:"error_description"`
+	URI         string `json:"error_uri"`
+}
+
+func (e *APIError) Error() string {
+	if e.Code == "" {
+		return fmt.Sprintf("invalid server response: %s", e.Status)
+	}
+	return fmt.Sprintf("invalid server response: %s: %s (%s)", e.Status, e.Code, e.Description)
+}
+
+// Unwrap maps well-known error codes to the sentinel errors of this package.
+func (e *APIError) Unwrap() error {
+	switch e.Code {
+	case "invalid_grant":
+		return ErrReAuthRequired
+	case "authorization_pending":
+		return ErrAuthorizationPending
+	case "authorization_expired":
+		return ErrPinExpired
+	case "invalid_client":
+		return ErrInvalidClient
+	default:
+		return nil
+	}
+}
+
+// readAPIError builds an APIError from the body of a failed response. The
+// error fields are left empty if the body can't be decoded.
+func readAPIError(status string, body io.Reader) *APIError {
+	apiErr := APIError{Status: status}
+	if bb, err := ioutil.ReadAll(body); err == nil {
+		_ = json.Unmarshal(bb, &apiErr)
+	}
+	return &apiErr
+}
+
+// Reasons returned by ErrorReason that don't come from an ecobee error code.
+const (
+	ReasonNetwork        = "network"
+	ReasonServer         = "server"
+	ReasonTokenStore     = "token_store"
+	ReasonNoRefreshToken = "no_refresh_token"
+	ReasonUnknown        = "unknown"
+)
+
+// ErrorReason categorizes an error returned while authenticating. Errors
+// from ecobee are categorized by a short name for their error code (e.g.,
+// invalid_grant or pin_expired), falling back to ReasonServer if the
+// response had no error code.
+func ErrorReason(err error) string {
+	switch {
+	case errors.Is(err, ErrReAuthRequired):
+		return "invalid_grant"
+	case errors.Is(err, ErrPinExpired):
+		return "pin_expired"
+	case errors.Is(err, ErrAuthorizationPending):
+		return "authorization_pending"
+	case errors.Is(err, ErrInvalidClient):
+		return "invalid_client"
+	case errors.Is(err, ErrNoRefreshToken):
+		return ReasonNoRefreshToken
+	case errors.Is(err, context.DeadlineExceeded), errors.Is(err, context.Canceled):
+		return ReasonNetwork
+	}
+
+	var (
+		apiErr *APIError
+		netErr net.Error
+	)
+	switch {
+	case errors.As(err, &apiErr) && apiErr.Code != "":
+		return apiErr.Code
+	case errors.As(err, &apiErr):
+		return ReasonServer
+	case errors.As(err, &netErr):
+		return ReasonNetwork
+	default:
+		return ReasonUnknown
+	}
+}
@@ -0,0 +1,45 @@
+package ecobeeauth
+
+import (
+	"errors"
+	"io"
+)
+
+// ErrResponseTooLarge is returned when reading a response body that is
+// larger than allowed.
+var ErrResponseTooLarge = errors.New("response body too large")
+
+// DefaultMaxResponseSize is the default value of WithMaxResponseSize.
+const DefaultMaxResponseSize = 1 << 20
+
+// LimitBody returns a ReadCloser that reads from rc until n bytes have been
+// read. Reading past n bytes fails with ErrResponseTooLarge rather than
+// silently truncating, which would surface as a confusing decoding error.
+func LimitBody(rc io.ReadCloser, n int64) io.ReadCloser {
+	return &limitedBody{rc: rc, remaining: n}
+}
+
+type limitedBody struct {
+	rc        io.ReadCloser
+	remaining int64
+}
+
+func (lb *limitedBody) Read(p []byte) (int, error) {
+	if lb.remaining < 0 {
+		return 0, ErrResponseTooLarge
+	}
+	// Read one byte more than allowed to detect bodies that are too large.
+	if int64(len(p)) > lb.remaining+1 {
+		p = p[:lb.remaining+1]
+	}
+	n, err := lb.rc.Read(p)
+	lb.remaining -= int64(n)
+	if lb.remaining < 0 {
+		return n + int(lb.remaining), ErrResponseTooLarge
+	}
+	return n, err
+}
+
+func (lb *limitedBody) Close() error {
+	return lb.rc.Close()
+}
@@ -0,0 +1,71 @@
+package ecobeeauth
+
+import (
+	"context"
+	"log"
+	"math/rand"
+	"time"
+)
+
+// noTokenPollInterval is how often the refresher checks for a token when
+// none is available.
+const noTokenPollInterval = time.Minute
+
+// RunRefresher refreshes the token in the background until ctx is canceled.
+// The token is refreshed before it expires, at a random time between
+// before+jitter and before ahead of its expiry. The jitter keeps processes
+// sharing a TokenStore from refreshing at the same time.
+func (ts *TokenSource) RunRefresher(ctx context.Context, before, jitter time.Duration) {
+	var (
+		// threshold is how long before expiry the token with expiry
+		// thresholdFor is refreshed. It is picked once per token so a wakeup
+		// always finds the token due for a refresh.
+		threshold    time.Duration
+		thresholdFor time.Time
+	)
+	for {
+		wait := noTokenPollInterval
+		if tok := ts.CachedToken(); tok != nil && !tok.Expiry.IsZero() {
+			if !tok.Expiry.Equal(thresholdFor) {
+				threshold, thresholdFor = before, tok.Expiry
+				if jitter > 0 {
+					threshold += time.Duration(rand.Int63n(int64(jitter)))
+				}
+			}
+			wait = time.Until(tok.Expiry) - threshold
+		}
+
+		if wait > 0 {
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(wait):
+			}
+		}
+
+		if err := ts.refreshBefore(ctx, threshold); err != nil {
+			log.Println("background token refresh failed:", err)
+
+			// Back off before trying again so a persistent failure doesn't spin.
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(noTokenPollInterval):
+			}
+		}
+	}
+}
+
+// refreshBefore refreshes the token if it expires within before.
+func (ts *TokenSource) refreshBefore(ctx context.Context, before time.Duration) error {
+	ts.mut.Lock()
+	defer ts.mut.Unlock()
+
+	if ts.tok == nil || ts.tok.Expiry.IsZero() || time.Until(ts.tok.Expiry) > before {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, time.Second*5)
+	defer cancel()
+	return ts.refresh(ctx)
+}
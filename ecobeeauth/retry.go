@@ -0,0 +1,54 @@
+package ecobeeauth
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+)
+
+// Bounds for retrying requests made during the pin authorization flow.
+const (
+	maxAttempts    = 3
+	initialBackoff = 500 * time.Millisecond
+)
+
+// doWithRetry sends the request created by newReq, retrying with backoff if
+// the request fails with a network error or a 5xx response. 4xx responses
+// are returned immediately since retrying won't change them. A new request
+// is created for each attempt so its body can be re-read.
+//
+// The last response or error is returned once all attempts are used or ctx
+// is canceled.
+func doWithRetry(ctx context.Context, newReq func() (*http.Request, error)) (*http.Response, error) {
+	backoff := initialBackoff
+	for attempt := 1; ; attempt++ {
+		req, err := newReq()
+		if err != nil {
+			return nil, err
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err == nil && resp.StatusCode < 500 {
+			return resp, nil
+		} else if attempt == maxAttempts {
+			return resp, err
+		}
+
+		if resp != nil {
+			// Drain the body so the connection can be reused.
+			_, _ = io.Copy(ioutil.Discard, resp.Body)
+			resp.Body.Close()
+		}
+
+		select {
+		case <-ctx.Done():
+			if err == nil {
+				err = ctx.Err()
+			}
+			return nil, err
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
@@ -0,0 +1,173 @@
+package ecobeeauth
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+// TokenStore persists the token used by a TokenSource so it survives
+// restarts of the process.
+type TokenStore interface {
+	// Load returns the stored token. If no token has been stored yet, Load
+	// returns a nil token and a nil error.
+	Load(ctx context.Context) (*oauth2.Token, error)
+
+	// Save stores tok, replacing any previously stored token.
+	Save(ctx context.Context, tok *oauth2.Token) error
+}
+
+// storedToken is the format tokens are persisted in. oauth2.Token doesn't
+// encode its extra fields, so the granted scopes and when the token was
+// obtained are kept alongside it.
+type storedToken struct {
+	*oauth2.Token
+	Scope      string     `json:"scope,omitempty"`
+	ObtainedAt *time.Time `json:"obtained_at,omitempty"`
+}
+
+// EncodeToken writes tok to w as JSON, including its scopes and when it was
+// obtained.
+func EncodeToken(w io.Writer, tok *oauth2.Token) error {
+	st := storedToken{Token: tok}
+	st.Scope, _ = tok.Extra(scopeKey).(string)
+	if t := ObtainedAt(tok); !t.IsZero() {
+		st.ObtainedAt = &t
+	}
+	return json.NewEncoder(w).Encode(st)
+}
+
+// DecodeToken reads a token written by EncodeToken. Tokens encoded directly
+// from an oauth2.Token are also accepted.
+func DecodeToken(r io.Reader) (*oauth2.Token, error) {
+	st := storedToken{Token: &oauth2.Token{}}
+	if err := json.NewDecoder(r).Decode(&st); err != nil {
+		return nil, err
+	}
+
+	extra := map[string]interface{}{}
+	if st.Scope != "" {
+		extra[scopeKey] = st.Scope
+	}
+	if st.ObtainedAt != nil {
+		extra[obtainedAtKey] = *st.ObtainedAt
+	}
+	if len(extra) == 0 {
+		return st.Token, nil
+	}
+	return st.Token.WithExtra(extra), nil
+}
+
+// Locker is implemented by TokenStores that may be shared between multiple
+// processes. The TokenSource holds the lock while refreshing so that only
+// one process refreshes the token at a time; the others wait and then load
+// the refreshed token from the store.
+type Locker interface {
+	// Lock blocks until the lock is acquired or ctx is canceled. The returned
+	// function releases the lock.
+	Lock(ctx context.Context) (unlock func(), err error)
+}
+
+// Locks older than staleLockAge are assumed to have been abandoned by a
+// process that died while holding them.
+const staleLockAge = 30 * time.Second
+
+// lockRetryInterval is how often to retry acquiring a held lock.
+const lockRetryInterval = 250 * time.Millisecond
+
+// DefaultDirMode is the default mode of directories created by FileStore.
+const DefaultDirMode os.FileMode = 0700
+
+// FileStore is a TokenStore that keeps the token as JSON in a file on the
+// local disk. It isn't meant to be shared between processes, so it doesn't
+// implement Locker and refreshing never depends on the file system beyond
+// saving the token.
+type FileStore struct {
+	Path string
+
+	// DirMode is the mode used to create the directory of Path if it doesn't
+	// exist when the token is first saved.
+	DirMode os.FileMode
+}
+
+// NewFileStore creates a new FileStore that caches the token at path.
+func NewFileStore(path string) *FileStore {
+	return &FileStore{Path: path, DirMode: DefaultDirMode}
+}
+
+// ensureDir creates the directory of the token file if it doesn't exist, so
+// the token can be saved to an empty volume without creating it first.
+func (fs *FileStore) ensureDir() error {
+	dir := filepath.Dir(fs.Path)
+	mode := fs.DirMode
+	if mode == 0 {
+		mode = DefaultDirMode
+	}
+	if err := os.MkdirAll(dir, mode); err != nil {
+		return fmt.Errorf("failed to create token cache directory %s: %w", dir, err)
+	}
+	return nil
+}
+
+// Load implements TokenStore.
+func (fs *FileStore) Load(_ context.Context) (*oauth2.Token, error) {
+	f, err := os.Open(fs.Path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	tok, err := DecodeToken(f)
+	if err != nil {
+		// Keep a copy of the corrupt file around for debugging, since it will
+		// be overwritten once a new token is saved.
+		if bakErr := copyFile(fs.Path, fs.Path+".bak"); bakErr != nil {
+			return nil, fmt.Errorf("%w: %s (backup failed: %s)", ErrCorruptToken, err, bakErr)
+		}
+		return nil, fmt.Errorf("%w: %s (backed up to %s.bak)", ErrCorruptToken, err, fs.Path)
+	}
+	return tok, nil
+}
+
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0660)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// Save implements TokenStore.
+func (fs *FileStore) Save(_ context.Context, tok *oauth2.Token) error {
+	if err := fs.ensureDir(); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(fs.Path, os.O_CREATE|os.O_TRUNC|os.O_RDWR, 0660)
+	if err != nil {
+		return fmt.Errorf("failed to cache file: %w", err)
+	}
+	defer f.Close()
+
+	if err := EncodeToken(f, tok); err != nil {
+		return fmt.Errorf("failed to encode token: %w", err)
+	}
+	return nil
+}
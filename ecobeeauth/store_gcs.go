@@ -0,0 +1,97 @@
+package ecobeeauth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"golang.org/x/oauth2"
+	"google.golang.org/api/googleapi"
+)
+
+// GCSStore is a TokenStore that keeps the token as JSON in a Google Cloud
+// Storage object.
+type GCSStore struct {
+	obj  *storage.ObjectHandle
+	lock *storage.ObjectHandle
+}
+
+// NewGCSStore creates a new GCSStore that stores the token at object in
+// bucket. Credentials are discovered using Application Default Credentials.
+func NewGCSStore(ctx context.Context, bucket, object string) (*GCSStore, error) {
+	cli, err := storage.NewClient(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create gcs client: %w", err)
+	}
+	return &GCSStore{
+		obj:  cli.Bucket(bucket).Object(object),
+		lock: cli.Bucket(bucket).Object(object + ".lock"),
+	}, nil
+}
+
+// Load implements TokenStore.
+func (s *GCSStore) Load(ctx context.Context) (*oauth2.Token, error) {
+	r, err := s.obj.NewReader(ctx)
+	if errors.Is(err, storage.ErrObjectNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to read gs://%s/%s: %w", s.obj.BucketName(), s.obj.ObjectName(), err)
+	}
+	defer r.Close()
+
+	tok, err := DecodeToken(r)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrCorruptToken, err)
+	}
+	return tok, nil
+}
+
+// Save implements TokenStore.
+func (s *GCSStore) Save(ctx context.Context, tok *oauth2.Token) error {
+	w := s.obj.NewWriter(ctx)
+	w.ContentType = "application/json"
+
+	if err := EncodeToken(w, tok); err != nil {
+		_ = w.Close()
+		return fmt.Errorf("failed to encode token: %w", err)
+	}
+	if err := w.Close(); err != nil {
+		return fmt.Errorf("failed to write gs://%s/%s: %w", s.obj.BucketName(), s.obj.ObjectName(), err)
+	}
+	return nil
+}
+
+// Lock implements Locker by creating a lock object next to the token object
+// only if it doesn't already exist.
+func (s *GCSStore) Lock(ctx context.Context) (func(), error) {
+	for {
+		w := s.lock.If(storage.Conditions{DoesNotExist: true}).NewWriter(ctx)
+		err := w.Close()
+		if err == nil {
+			return func() {
+				ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+				defer cancel()
+				_ = s.lock.Delete(ctx)
+			}, nil
+		}
+
+		var gerr *googleapi.Error
+		if !errors.As(err, &gerr) || gerr.Code != http.StatusPreconditionFailed {
+			return nil, fmt.Errorf("failed to create lock gs://%s/%s: %w", s.lock.BucketName(), s.lock.ObjectName(), err)
+		}
+
+		if attrs, err := s.lock.Attrs(ctx); err == nil && time.Since(attrs.Created) > staleLockAge {
+			_ = s.lock.If(storage.Conditions{GenerationMatch: attrs.Generation}).Delete(ctx)
+			continue
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(lockRetryInterval):
+		}
+	}
+}
@@ -0,0 +1,44 @@
+package ecobeeauth
+
+import (
+	"context"
+	"sync"
+
+	"golang.org/x/oauth2"
+)
+
+// MemoryTokenStore is a TokenStore that only keeps the token in memory. The
+// token is lost when the process exits, so the pin authorization flow must
+// be run again after every restart. It's useful for tests and for
+// deployments that intentionally don't persist tokens.
+type MemoryTokenStore struct {
+	mut sync.Mutex
+	tok *oauth2.Token
+}
+
+// NewMemoryTokenStore creates a new MemoryTokenStore. If tok is non-nil, it
+// is returned by the first Load.
+func NewMemoryTokenStore(tok *oauth2.Token) *MemoryTokenStore {
+	return &MemoryTokenStore{tok: tok}
+}
+
+// Load implements TokenStore.
+func (ms *MemoryTokenStore) Load(_ context.Context) (*oauth2.Token, error) {
+	ms.mut.Lock()
+	defer ms.mut.Unlock()
+	if ms.tok == nil {
+		return nil, nil
+	}
+	// Return a copy so callers can't modify the stored token.
+	tok := *ms.tok
+	return &tok, nil
+}
+
+// Save implements TokenStore.
+func (ms *MemoryTokenStore) Save(_ context.Context, tok *oauth2.Token) error {
+	ms.mut.Lock()
+	defer ms.mut.Unlock()
+	stored := *tok
+	ms.tok = &stored
+	return nil
+}
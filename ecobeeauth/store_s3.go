@@ -0,0 +1,144 @@
+package ecobeeauth
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"golang.org/x/oauth2"
+)
+
+// S3Store is a TokenStore that keeps the token as JSON in an S3 object.
+type S3Store struct {
+	cli    *s3.S3
+	bucket string
+	key    string
+}
+
+// NewS3Store creates a new S3Store that stores the token at key in bucket.
+// Credentials and region are discovered using the default AWS SDK chain
+// (environment, shared config, instance role).
+func NewS3Store(bucket, key string) (*S3Store, error) {
+	sess, err := session.NewSessionWithOptions(session.Options{
+		SharedConfigState: session.SharedConfigEnable,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create aws session: %w", err)
+	}
+	return &S3Store{
+		cli:    s3.New(sess),
+		bucket: bucket,
+		key:    key,
+	}, nil
+}
+
+// Load implements TokenStore.
+func (s *S3Store) Load(ctx context.Context) (*oauth2.Token, error) {
+	resp, err := s.cli.GetObjectWithContext(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(s.key),
+	})
+	var aerr awserr.Error
+	if errors.As(err, &aerr) && aerr.Code() == s3.ErrCodeNoSuchKey {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to read s3://%s/%s: %w", s.bucket, s.key, err)
+	}
+	defer resp.Body.Close()
+
+	tok, err := DecodeToken(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrCorruptToken, err)
+	}
+	return tok, nil
+}
+
+// Save implements TokenStore.
+func (s *S3Store) Save(ctx context.Context, tok *oauth2.Token) error {
+	var buf bytes.Buffer
+	if err := EncodeToken(&buf, tok); err != nil {
+		return fmt.Errorf("failed to encode token: %w", err)
+	}
+	_, err := s.cli.PutObjectWithContext(ctx, &s3.PutObjectInput{
+		Bucket:      aws.String(s.bucket),
+		Key:         aws.String(s.key),
+		Body:        bytes.NewReader(buf.Bytes()),
+		ContentType: aws.String("application/json"),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to write s3://%s/%s: %w", s.bucket, s.key, err)
+	}
+	return nil
+}
+
+// Lock implements Locker by creating a lock object next to the token object
+// only if it doesn't already exist.
+//
+// The conditional writes S3 supports aren't modeled by this version of the
+// AWS SDK, so the If-None-Match and If-Match headers are set on the requests
+// directly.
+func (s *S3Store) Lock(ctx context.Context) (func(), error) {
+	lockKey := s.key + ".lock"
+	for {
+		req, _ := s.cli.PutObjectRequest(&s3.PutObjectInput{
+			Bucket: aws.String(s.bucket),
+			Key:    aws.String(lockKey),
+			Body:   bytes.NewReader(nil),
+		})
+		req.HTTPRequest.Header.Set("If-None-Match", "*")
+		err := sendWithContext(ctx, req)
+		if err == nil {
+			return func() {
+				ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+				defer cancel()
+				_, _ = s.cli.DeleteObjectWithContext(ctx, &s3.DeleteObjectInput{
+					Bucket: aws.String(s.bucket),
+					Key:    aws.String(lockKey),
+				})
+			}, nil
+		}
+
+		// 412 means the lock is held. 409 means another process is creating it
+		// at the same time.
+		var rerr awserr.RequestFailure
+		if !errors.As(err, &rerr) || (rerr.StatusCode() != http.StatusPreconditionFailed && rerr.StatusCode() != http.StatusConflict) {
+			return nil, fmt.Errorf("failed to create lock s3://%s/%s: %w", s.bucket, lockKey, err)
+		}
+
+		head, err := s.cli.HeadObjectWithContext(ctx, &s3.HeadObjectInput{
+			Bucket: aws.String(s.bucket),
+			Key:    aws.String(lockKey),
+		})
+		if err == nil && head.LastModified != nil && time.Since(*head.LastModified) > staleLockAge {
+			// Only delete the stale lock if it wasn't replaced in the meantime.
+			req, _ := s.cli.DeleteObjectRequest(&s3.DeleteObjectInput{
+				Bucket: aws.String(s.bucket),
+				Key:    aws.String(lockKey),
+			})
+			if head.ETag != nil {
+				req.HTTPRequest.Header.Set("If-Match", *head.ETag)
+			}
+			_ = sendWithContext(ctx, req)
+			continue
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(lockRetryInterval):
+		}
+	}
+}
+
+func sendWithContext(ctx context.Context, req *request.Request) error {
+	req.SetContext(ctx)
+	return req.Send()
+}
@@ -0,0 +1,65 @@
+package main
+
+import "github.com/rspier/go-ecobee/ecobee"
+
+// equipment is the state of a single piece of equipment reported in a
+// thermostat summary.
+type equipment struct {
+	Name string
+	On   bool
+}
+
+// equipmentList flattens es into a list of equipment in a stable order. Names
+// match the equipment names used by the ecobee API.
+func equipmentList(es ecobee.EquipmentStatus) []equipment {
+	return []equipment{
+		{"heatPump", es.HeatPump},
+		{"heatPump2", es.HeatPump2},
+		{"heatPump3", es.HeatPump3},
+		{"compCool1", es.CompCool1},
+		{"compCool2", es.CompCool2},
+		{"auxHeat1", es.AuxHeat1},
+		{"auxHeat2", es.AuxHeat2},
+		{"auxHeat3", es.AuxHeat3},
+		{"fan", es.Fan},
+		{"humidifier", es.Humidifier},
+		{"dehumidifier", es.Dehumidifier},
+		{"ventilator", es.Ventilator},
+		{"economizer", es.Economizer},
+		{"compHotWater", es.CompHotWater},
+		{"auxHotWater", es.AuxHotWater},
+	}
+}
+
+// Values of the state label of ecobee_system_state.
+const (
+	stateHeating = "heating"
+	stateCooling = "cooling"
+	stateFanOnly = "fan_only"
+	stateIdle    = "idle"
+)
+
+var systemStates = []string{stateHeating, stateCooling, stateFanOnly, stateIdle}
+
+// systemState collapses es into the single state the HVAC system is in.
+// Heating takes priority over cooling since they should never run together
+// and a heat stage running is the more important signal.
+func systemState(es ecobee.EquipmentStatus) string {
+	switch {
+	case es.HeatPump || es.HeatPump2 || es.HeatPump3 || es.AuxHeat1 || es.AuxHeat2 || es.AuxHeat3:
+		return stateHeating
+	case es.CompCool1 || es.CompCool2:
+		return stateCooling
+	case es.Fan:
+		return stateFanOnly
+	default:
+		return stateIdle
+	}
+}
+
+func onOff(on bool) string {
+	if on {
+		return "on"
+	}
+	return "off"
+}
@@ -0,0 +1,1616 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rspier/go-ecobee/ecobee"
+	"golang.org/x/sync/errgroup"
+)
+
+// errThermostatNotFound is returned when the ecobee API responds
+// successfully but without the requested thermostat.
+var errThermostatNotFound = errors.New("thermostat not found")
+
+func getThermostat(ctx context.Context, c *ecobee.Client, thermostatID string, collectors collectorSet) (*thermostat, error) {
+	s := ecobee.Selection{
+		SelectionType:  "thermostats",
+		SelectionMatch: thermostatID,
+	}
+	collectors.applySelection(&s)
+	thermostats, err := getThermostats(ctx, c, s)
+	if err != nil {
+		return nil, err
+	}
+	// ecobee occasionally returns other thermostats registered to the account
+	// alongside the requested one.
+	for i := range thermostats {
+		if thermostats[i].Identifier == thermostatID {
+			return &thermostats[i], nil
+		}
+	}
+	return nil, fmt.Errorf("%w: %s not in response of %d thermostats", errThermostatNotFound, thermostatID, len(thermostats))
+}
+
+func getThermostatSummary(ctx context.Context, c *ecobee.Client, thermostatID string) (*thermostatSummary, error) {
+	tss, err := getThermostatSummaries(ctx, c, ecobee.Selection{
+		SelectionType:  "thermostats",
+		SelectionMatch: thermostatID,
+
+		IncludeEquipmentStatus: true,
+		IncludeAlerts:          false,
+		IncludeEvents:          true,
+		IncludeProgram:         true,
+		IncludeRuntime:         true,
+		IncludeExtendedRuntime: false,
+		IncludeSettings:        false,
+		IncludeSensors:         true,
+		IncludeWeather:         true,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed getting thermostat summary: %w", err)
+	}
+
+	summary, ok := tss[thermostatID]
+	if !ok {
+		return nil, fmt.Errorf("%w in summary", errThermostatNotFound)
+	}
+	return &summary, nil
+}
+
+// getRegisteredThermostats returns the thermostat summaries of all
+// thermostats registered to the account the client is authenticated as.
+func getRegisteredThermostats(ctx context.Context, c *ecobee.Client) (map[string]ecobee.ThermostatSummary, error) {
+	tss, err := clientWithContext(ctx, c).GetThermostatSummary(ecobee.Selection{
+		SelectionType:  "registered",
+		SelectionMatch: "",
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed getting registered thermostats: %w", err)
+	}
+	return tss, nil
+}
+
+// ExporterConfig configures an Exporter.
+type ExporterConfig struct {
+	ThermostatID string
+
+	// Collectors is the set of enabled metric groups.
+	Collectors collectorSet
+
+	// TemperatureUnit is the unit temperatures are reported in.
+	TemperatureUnit temperatureUnit
+
+	// TemperaturePrecision is the number of decimal places temperatures are
+	// rounded to. Temperatures aren't rounded if it's negative.
+	TemperaturePrecision int
+
+	// IncludeThermostatSensor reports the thermostat's built-in sensor in the
+	// per-sensor metrics alongside the remote sensors.
+	IncludeThermostatSensor bool
+
+	// FullFetchInterval, if non-zero, is the longest time the full thermostat
+	// is cached before being fetched again, even if the runtime revision
+	// hasn't changed.
+	FullFetchInterval time.Duration
+
+	// WeatherForecastIndex is the forecast that ecobee_outside_temperature is
+	// taken from. The first forecast holds the current conditions.
+	WeatherForecastIndex int
+
+	// ShortCycleThreshold is the length of an equipment cycle below which
+	// it's counted as a short cycle.
+	ShortCycleThreshold time.Duration
+
+	// RequireThermostatAttempts, if non-zero, is the number of consecutive
+	// scrapes that may fail to find the thermostat before the process exits.
+	// Other API errors don't count towards the limit.
+	RequireThermostatAttempts int
+
+	// MetricFilter, if set, limits the metrics that are emitted by name.
+	MetricFilter *metricFilter
+
+	// HelpOverrides replaces the help text of metrics, keyed by metric name.
+	HelpOverrides map[string]string
+
+	// RateLimiter, if set, is the transport used by the ecobee client. API
+	// calls are skipped while it is backing off from a 429.
+	RateLimiter *rateLimitTransport
+
+	// Maintenance, if set, is a transport used by the ecobee client that
+	// detects ecobee maintenance windows. Failed scrapes during a window
+	// aren't counted as scrape errors.
+	Maintenance *maintenanceTransport
+}
+
+func (cfg ExporterConfig) temperatureFormat() temperatureFormat {
+	return temperatureFormat{unit: cfg.TemperatureUnit, precision: cfg.TemperaturePrecision}
+}
+
+// help returns the help text for the metric name, which is def unless it's
+// overridden in HelpOverrides.
+func (cfg ExporterConfig) help(name, def string) string {
+	if h, ok := cfg.HelpOverrides[name]; ok {
+		return h
+	}
+	return def
+}
+
+// Exporter collects metrics about a thermostat. Gauges are built as
+// constant metrics from the cached thermostat on every scrape, so series for
+// sensors, events, or climates that disappear stop being reported. Only
+// counters keep state between scrapes.
+type Exporter struct {
+	// mut guards the cached thermostat state against concurrent scrapes.
+	mut sync.Mutex
+
+	cli          *ecobee.Client
+	thermo       *thermostat
+	summary      *thermostatSummary
+	thermostatID string
+	collectors   collectorSet
+	rateLimiter  *rateLimitTransport
+	maintenance  *maintenanceTransport
+
+	includeThermostatSensor bool
+
+	// thermoFetched is when thermo was last fetched.
+	thermoFetched     time.Time
+	fullFetchInterval time.Duration
+	filter            *metricFilter
+	forecastIndex     int
+
+	// prevEquipment is the equipment status from the previous refresh, used
+	// to detect transitions. nil until the first refresh.
+	prevEquipment *ecobee.EquipmentStatus
+
+	// changes is what the most recent refresh of the thermostat changed.
+	changes refreshChanges
+
+	// equipmentOnSince is when each running piece of equipment was seen
+	// turning on.
+	equipmentOnSince    map[string]time.Time
+	shortCycleThreshold time.Duration
+
+	// lastCycle is how long each piece of equipment ran during its last
+	// completed cycle.
+	lastCycle map[string]time.Duration
+
+	// auxHeatCounted is the timestamp of the last extended runtime interval
+	// added to auxHeatSeconds.
+	auxHeatCounted time.Time
+
+	// notFoundScrapes is the number of consecutive scrapes where ecobee
+	// didn't return the thermostat.
+	notFoundScrapes       int
+	requireThermoAttempts int
+
+	// failedScrapes is the number of consecutive scrapes that failed to
+	// retrieve the thermostat.
+	failedScrapes int
+
+	// hasScrapedSuccessfully is set once a scrape has retrieved the
+	// thermostat from the ecobee API.
+	hasScrapedSuccessfully bool
+
+	// background is set once backgroundRefresh has been called. refreshOK
+	// is whether its latest refresh succeeded.
+	background bool
+	refreshOK  bool
+
+	// registeredChecked is set once the thermostat ID has been checked
+	// against the thermostats registered to the account.
+	registeredChecked bool
+	registeredFound   bool
+	configuredFound   *prometheus.Desc
+
+	up             *prometheus.Desc
+	scrapeErrors   prometheus.Counter
+	consecFailures *prometheus.Desc
+	summaryFetches prometheus.Counter
+	fullFetches    prometheus.Counter
+	callsSaved     prometheus.Counter
+	thermostatInfo *prometheus.Desc
+	revisionsInfo  *prometheus.Desc
+	rateLimited    *prometheus.Desc
+	inMaintenance  *prometheus.Desc
+	quotaLimit     *prometheus.Desc
+	quotaRemaining *prometheus.Desc
+	insideTemp     *temperatureDesc
+	insideHumidity *prometheus.Desc
+	outsideTemp    *temperatureDesc
+	weatherAvail   *prometheus.Desc
+	weatherStation *prometheus.Desc
+	weatherTime    *prometheus.Desc
+	desiredHeat    *temperatureDesc
+	desiredCool    *temperatureDesc
+	eventHeat      *temperatureDesc
+	eventCool      *temperatureDesc
+	drActive       *prometheus.Desc
+	drHeatOffset   *temperatureDesc
+	drCoolOffset   *temperatureDesc
+	cooling        *prometheus.Desc
+	heating        *prometheus.Desc
+	coolingStages  *prometheus.Desc
+	heatingStages  *prometheus.Desc
+	fanRunning     *prometheus.Desc
+	auxHeatActive  *prometheus.Desc
+	auxHeatSeconds prometheus.Counter
+	systemState    *prometheus.Desc
+	equipmentRaw   *prometheus.Desc
+	transitions    *prometheus.CounterVec
+	cycleDuration  *prometheus.Desc
+	shortCycles    *prometheus.CounterVec
+	homeOccupied   *prometheus.Desc
+	sensorTemp     *temperatureDesc
+	sensorOccupied *prometheus.Desc
+	followingSched *prometheus.Desc
+	holdEndsIn     *prometheus.Desc
+	climateSensor  *prometheus.Desc
+	nextClimate    *prometheus.Desc
+	overridden     *prometheus.Desc
+	smartRecovery  *prometheus.Desc
+	autoAway       *prometheus.Desc
+	fanRuntime     *prometheus.Desc
+	fanMinOn       *prometheus.Desc
+	fanSpeed       *prometheus.Desc
+	ventRuntime    *prometheus.Desc
+	ventMinOn      *prometheus.Desc
+	ventType       *prometheus.Desc
+	tempCorrection *temperatureDesc
+	heatRangeLow   *temperatureDesc
+	heatRangeHigh  *temperatureDesc
+	coolRangeLow   *temperatureDesc
+	coolRangeHigh  *temperatureDesc
+	settingsMiss   prometheus.Counter
+	dehumidWithAC  *prometheus.Desc
+	overcoolOffset *temperatureDesc
+	compMinOutdoor *temperatureDesc
+	auxMaxOutdoor  *temperatureDesc
+	holdAction     *prometheus.Desc
+	lastModified   *prometheus.Desc
+	connectedTime  *prometheus.Desc
+	runtimeAge     *prometheus.Desc
+	clockSkew      *prometheus.Desc
+	locationInfo   *prometheus.Desc
+	reminderOn     *prometheus.Desc
+	filterLife     *prometheus.Desc
+	latitude       *prometheus.Desc
+	longitude      *prometheus.Desc
+}
+
+func NewExporter(cli *ecobee.Client, cfg ExporterConfig) *Exporter {
+	// Every metric is labeled with the thermostat it's about, so exporters
+	// for several thermostats can be collected together.
+	constLabels := prometheus.Labels{"thermostat_id": cfg.ThermostatID}
+
+	return &Exporter{
+		cli:          cli,
+		thermostatID: cfg.ThermostatID,
+		collectors:   cfg.Collectors,
+		rateLimiter:  cfg.RateLimiter,
+		maintenance:  cfg.Maintenance,
+
+		includeThermostatSensor: cfg.IncludeThermostatSensor,
+		fullFetchInterval:       cfg.FullFetchInterval,
+		filter:                  cfg.MetricFilter,
+		forecastIndex:           cfg.WeatherForecastIndex,
+		equipmentOnSince:        map[string]time.Time{},
+		lastCycle:               map[string]time.Duration{},
+		shortCycleThreshold:     cfg.ShortCycleThreshold,
+		requireThermoAttempts:   cfg.RequireThermostatAttempts,
+
+		up: prometheus.NewDesc(
+			"ecobee_up",
+			cfg.help("ecobee_up", "1 if the thermostat was successfully retrieved from the ecobee API."),
+			nil, constLabels,
+		),
+		scrapeErrors: prometheus.NewCounter(prometheus.CounterOpts{
+			Name:        "ecobee_scrape_errors_total",
+			Help:        cfg.help("ecobee_scrape_errors_total", "Total number of scrapes that failed to retrieve the thermostat or to collect its metrics."),
+			ConstLabels: constLabels,
+		}),
+		consecFailures: prometheus.NewDesc(
+			"ecobee_consecutive_scrape_failures",
+			cfg.help("ecobee_consecutive_scrape_failures", "Number of consecutive scrapes that failed to retrieve the thermostat. Reset to 0 by a successful scrape."),
+			nil, constLabels,
+		),
+		summaryFetches: prometheus.NewCounter(prometheus.CounterOpts{
+			Name:        "ecobee_summary_fetches_total",
+			Help:        cfg.help("ecobee_summary_fetches_total", "Total number of thermostat summaries requested from the ecobee API."),
+			ConstLabels: constLabels,
+		}),
+		callsSaved: prometheus.NewCounter(prometheus.CounterOpts{
+			Name:        "ecobee_api_calls_saved_total",
+			Help:        cfg.help("ecobee_api_calls_saved_total", "Total number of ecobee API requests avoided by serving the cached thermostat."),
+			ConstLabels: constLabels,
+		}),
+		fullFetches: prometheus.NewCounter(prometheus.CounterOpts{
+			Name:        "ecobee_full_thermostat_fetches_total",
+			Help:        cfg.help("ecobee_full_thermostat_fetches_total", "Total number of full thermostats requested from the ecobee API."),
+			ConstLabels: constLabels,
+		}),
+		thermostatInfo: prometheus.NewDesc(
+			"ecobee_thermostat_info",
+			cfg.help("ecobee_thermostat_info", "Name of the thermostat from the latest summary. Always 1."),
+			[]string{"thermostat_name"}, constLabels,
+		),
+		revisionsInfo: prometheus.NewDesc(
+			"ecobee_revisions_info",
+			cfg.help("ecobee_revisions_info", "The runtime, interval, thermostat, and alerts revisions of the thermostat from the latest summary. Each revision changes when ecobee has new data of that kind."),
+			[]string{"runtime", "interval", "thermostat", "alerts"}, constLabels,
+		),
+		rateLimited: prometheus.NewDesc(
+			"ecobee_api_rate_limited",
+			cfg.help("ecobee_api_rate_limited", "1 while backing off after being rate limited by the ecobee API."),
+			nil, constLabels,
+		),
+		inMaintenance: prometheus.NewDesc(
+			"ecobee_api_maintenance",
+			cfg.help("ecobee_api_maintenance", "1 while the ecobee API is down for planned maintenance."),
+			nil, constLabels,
+		),
+		quotaLimit: prometheus.NewDesc(
+			"ecobee_api_rate_limit_limit",
+			cfg.help("ecobee_api_rate_limit_limit", "Number of requests allowed by the ecobee API rate limit."),
+			nil, constLabels,
+		),
+		quotaRemaining: prometheus.NewDesc(
+			"ecobee_api_rate_limit_remaining",
+			cfg.help("ecobee_api_rate_limit_remaining", "Number of requests remaining before being rate limited by the ecobee API."),
+			nil, constLabels,
+		),
+		insideTemp: newTemperatureDesc(
+			"ecobee_inside_temperature",
+			cfg.help("ecobee_inside_temperature", "Indoor temperature."),
+			cfg.temperatureFormat(), false, constLabels,
+		),
+		insideHumidity: prometheus.NewDesc(
+			"ecobee_inside_humidity",
+			cfg.help("ecobee_inside_humidity", "Indoor humidity"),
+			nil, constLabels,
+		),
+		outsideTemp: newTemperatureDesc(
+			"ecobee_outside_temperature",
+			cfg.help("ecobee_outside_temperature", "Outside temperature."),
+			cfg.temperatureFormat(), false, constLabels,
+		),
+		weatherAvail: prometheus.NewDesc(
+			"ecobee_weather_available",
+			cfg.help("ecobee_weather_available", "1 if ecobee returned weather data for the thermostat."),
+			nil, constLabels,
+		),
+		weatherStation: prometheus.NewDesc(
+			"ecobee_weather_station_info",
+			cfg.help("ecobee_weather_station_info", "Weather station ecobee takes the thermostat's weather from. Always 1."),
+			[]string{"station"}, constLabels,
+		),
+		weatherTime: prometheus.NewDesc(
+			"ecobee_weather_observation_timestamp_seconds",
+			cfg.help("ecobee_weather_observation_timestamp_seconds", "Unix timestamp of the weather forecast ecobee_outside_temperature is taken from."),
+			nil, constLabels,
+		),
+		desiredHeat: newTemperatureDesc(
+			"ecobee_desired_heat",
+			cfg.help("ecobee_desired_heat", "Desired minimum temperature to heat to."),
+			cfg.temperatureFormat(), false, constLabels,
+		),
+		desiredCool: newTemperatureDesc(
+			"ecobee_desired_cool",
+			cfg.help("ecobee_desired_cool", "Desired maximum temperature to cool to."),
+			cfg.temperatureFormat(), false, constLabels,
+		),
+		eventHeat: newTemperatureDesc(
+			"ecobee_event_desired_heat",
+			cfg.help("ecobee_event_desired_heat", "Heat hold temperature of the running event, such as a hold or vacation."),
+			cfg.temperatureFormat(), false, constLabels,
+			"event",
+		),
+		eventCool: newTemperatureDesc(
+			"ecobee_event_desired_cool",
+			cfg.help("ecobee_event_desired_cool", "Cool hold temperature of the running event, such as a hold or vacation."),
+			cfg.temperatureFormat(), false, constLabels,
+			"event",
+		),
+		drActive: prometheus.NewDesc(
+			"ecobee_demand_response_active",
+			cfg.help("ecobee_demand_response_active", "1 if a utility demand response event is adjusting the thermostat."),
+			nil, constLabels,
+		),
+		drHeatOffset: newTemperatureDesc(
+			"ecobee_demand_response_heat_offset",
+			cfg.help("ecobee_demand_response_heat_offset", "How far the running demand response event moves the heat setpoint. Only reported for events relative to the scheduled setpoints."),
+			cfg.temperatureFormat(), true, constLabels,
+		),
+		drCoolOffset: newTemperatureDesc(
+			"ecobee_demand_response_cool_offset",
+			cfg.help("ecobee_demand_response_cool_offset", "How far the running demand response event moves the cool setpoint. Only reported for events relative to the scheduled setpoints."),
+			cfg.temperatureFormat(), true, constLabels,
+		),
+		cooling: prometheus.NewDesc(
+			"ecobee_cooling_stage",
+			cfg.help("ecobee_cooling_stage", "Stage of compressors for cooling that are running"),
+			[]string{"stage"}, constLabels,
+		),
+		heating: prometheus.NewDesc(
+			"ecobee_heating_stage",
+			cfg.help("ecobee_heating_stage", "Stage of pumps for heating that are running"),
+			[]string{"stage"}, constLabels,
+		),
+		coolingStages: prometheus.NewDesc(
+			"ecobee_cooling_active_stages",
+			cfg.help("ecobee_cooling_active_stages", "Number of cooling stages that are running."),
+			nil, constLabels,
+		),
+		heatingStages: prometheus.NewDesc(
+			"ecobee_heating_active_stages",
+			cfg.help("ecobee_heating_active_stages", "Number of heating stages, including auxiliary heat, that are running."),
+			nil, constLabels,
+		),
+		fanRunning: prometheus.NewDesc(
+			"ecobee_fan_running",
+			cfg.help("ecobee_fan_running", "1 if the fan is running"),
+			nil, constLabels,
+		),
+		fanRuntime: prometheus.NewDesc(
+			"ecobee_fan_runtime_fraction",
+			cfg.help("ecobee_fan_runtime_fraction", "Fraction of time the fan ran over the most recent extended runtime intervals."),
+			nil, constLabels,
+		),
+		fanMinOn: prometheus.NewDesc(
+			"ecobee_fan_min_on_fraction",
+			cfg.help("ecobee_fan_min_on_fraction", "Configured minimum fraction of each hour the fan should run."),
+			nil, constLabels,
+		),
+		fanSpeed: prometheus.NewDesc(
+			"ecobee_fan_speed_info",
+			cfg.help("ecobee_fan_speed_info", "Configured speed of a variable speed fan (low, medium, high, or optimized). Always 1. Not reported for single speed fans."),
+			[]string{"speed"}, constLabels,
+		),
+		ventRuntime: prometheus.NewDesc(
+			"ecobee_ventilator_runtime_fraction",
+			cfg.help("ecobee_ventilator_runtime_fraction", "Fraction of time the ventilator ran over the most recent extended runtime intervals."),
+			nil, constLabels,
+		),
+		ventMinOn: prometheus.NewDesc(
+			"ecobee_ventilator_min_on_time_minutes",
+			cfg.help("ecobee_ventilator_min_on_time_minutes", "Configured minimum number of minutes per hour the ventilator should run."),
+			nil, constLabels,
+		),
+		ventType: prometheus.NewDesc(
+			"ecobee_ventilator_type",
+			cfg.help("ecobee_ventilator_type", "Type of ventilator installed (none, ventilator, hrv, or erv). Always 1."),
+			[]string{"type"}, constLabels,
+		),
+		nextClimate: prometheus.NewDesc(
+			"ecobee_next_climate_change_seconds",
+			cfg.help("ecobee_next_climate_change_seconds", "Seconds until the schedule changes to the next climate."),
+			[]string{"climate"}, constLabels,
+		),
+		overridden: prometheus.NewDesc(
+			"ecobee_climate_overridden",
+			cfg.help("ecobee_climate_overridden", "1 if the running climate differs from the climate the schedule holds for the current time."),
+			nil, constLabels,
+		),
+		smartRecovery: prometheus.NewDesc(
+			"ecobee_smart_recovery_active",
+			cfg.help("ecobee_smart_recovery_active", "1 if Smart Recovery is moving the desired temperatures away from the running climate ahead of the next climate. Derived from the runtime desired temperatures while no event is running."),
+			nil, constLabels,
+		),
+		autoAway: prometheus.NewDesc(
+			"ecobee_auto_away_active",
+			cfg.help("ecobee_auto_away_active", "1 if Smart Home/Away is overriding the schedule based on occupancy. Derived from running autoAway and autoHome events."),
+			nil, constLabels,
+		),
+		tempCorrection: newTemperatureDesc(
+			"ecobee_temperature_correction",
+			cfg.help("ecobee_temperature_correction", "Calibration offset applied to the thermostat's temperature sensor."),
+			cfg.temperatureFormat(), true, constLabels,
+		),
+		heatRangeLow: newTemperatureDesc(
+			"ecobee_heat_range_low",
+			cfg.help("ecobee_heat_range_low", "Lowest heat setpoint allowed by the thermostat."),
+			cfg.temperatureFormat(), false, constLabels,
+		),
+		heatRangeHigh: newTemperatureDesc(
+			"ecobee_heat_range_high",
+			cfg.help("ecobee_heat_range_high", "Highest heat setpoint allowed by the thermostat."),
+			cfg.temperatureFormat(), false, constLabels,
+		),
+		coolRangeLow: newTemperatureDesc(
+			"ecobee_cool_range_low",
+			cfg.help("ecobee_cool_range_low", "Lowest cool setpoint allowed by the thermostat."),
+			cfg.temperatureFormat(), false, constLabels,
+		),
+		coolRangeHigh: newTemperatureDesc(
+			"ecobee_cool_range_high",
+			cfg.help("ecobee_cool_range_high", "Highest cool setpoint allowed by the thermostat."),
+			cfg.temperatureFormat(), false, constLabels,
+		),
+		climateSensor: prometheus.NewDesc(
+			"ecobee_climate_sensor",
+			cfg.help("ecobee_climate_sensor", "1 for each sensor that participates in the temperature averaging of a climate."),
+			[]string{"climate", "sensor_id"}, constLabels,
+		),
+		holdEndsIn: prometheus.NewDesc(
+			"ecobee_hold_ends_in_seconds",
+			cfg.help("ecobee_hold_ends_in_seconds", "Seconds until the running hold ends and the thermostat returns to its schedule. Not reported for indefinite holds."),
+			nil, constLabels,
+		),
+		followingSched: prometheus.NewDesc(
+			"ecobee_following_schedule",
+			cfg.help("ecobee_following_schedule", "1 if the thermostat is following its program schedule, 0 if a hold, vacation, or similar event overrides it."),
+			nil, constLabels,
+		),
+		sensorTemp: newTemperatureDesc(
+			"ecobee_sensor_temperature",
+			cfg.help("ecobee_sensor_temperature", "Temperature reported by a sensor."),
+			cfg.temperatureFormat(), false, constLabels,
+			"sensor_id", "sensor_name",
+		),
+		sensorOccupied: prometheus.NewDesc(
+			"ecobee_sensor_occupied",
+			cfg.help("ecobee_sensor_occupied", "1 if a sensor currently detects occupancy."),
+			[]string{"sensor_id", "sensor_name"}, constLabels,
+		),
+		settingsMiss: prometheus.NewCounter(prometheus.CounterOpts{
+			Name:        "ecobee_settings_missing_total",
+			Help:        cfg.help("ecobee_settings_missing_total", "Total number of scrapes where ecobee returned the thermostat without settings or with empty settings."),
+			ConstLabels: constLabels,
+		}),
+		dehumidWithAC: prometheus.NewDesc(
+			"ecobee_dehumidify_with_ac",
+			cfg.help("ecobee_dehumidify_with_ac", "1 if the AC may overcool to dehumidify."),
+			nil, constLabels,
+		),
+		overcoolOffset: newTemperatureDesc(
+			"ecobee_dehumidify_overcool_offset",
+			cfg.help("ecobee_dehumidify_overcool_offset", "How far below the cool setpoint the AC may overcool to dehumidify."),
+			cfg.temperatureFormat(), true, constLabels,
+		),
+		compMinOutdoor: newTemperatureDesc(
+			"ecobee_compressor_min_outdoor_temp",
+			cfg.help("ecobee_compressor_min_outdoor_temp", "Outdoor temperature below which the compressor is locked out."),
+			cfg.temperatureFormat(), false, constLabels,
+		),
+		auxMaxOutdoor: newTemperatureDesc(
+			"ecobee_aux_heat_max_outdoor_temp",
+			cfg.help("ecobee_aux_heat_max_outdoor_temp", "Outdoor temperature above which auxiliary heat isn't used."),
+			cfg.temperatureFormat(), false, constLabels,
+		),
+		holdAction: prometheus.NewDesc(
+			"ecobee_hold_action",
+			cfg.help("ecobee_hold_action", "Configured duration of manual holds, as reported by ecobee. Always 1."),
+			[]string{"action"}, constLabels,
+		),
+		homeOccupied: prometheus.NewDesc(
+			"ecobee_home_occupied",
+			cfg.help("ecobee_home_occupied", "1 if any sensor, including the thermostat, currently detects occupancy."),
+			nil, constLabels,
+		),
+		auxHeatActive: prometheus.NewDesc(
+			"ecobee_aux_heat_active",
+			cfg.help("ecobee_aux_heat_active", "1 if any auxiliary heat stage is running."),
+			nil, constLabels,
+		),
+		auxHeatSeconds: prometheus.NewCounter(prometheus.CounterOpts{
+			Name:        "ecobee_aux_heat_seconds_total",
+			Help:        cfg.help("ecobee_aux_heat_seconds_total", "Total seconds auxiliary heat stages ran, summed across stages, from extended runtime intervals seen by the exporter."),
+			ConstLabels: constLabels,
+		}),
+		systemState: prometheus.NewDesc(
+			"ecobee_system_state",
+			cfg.help("ecobee_system_state", "1 for the state the HVAC system is in (heating, cooling, fan_only, or idle), 0 for the others."),
+			[]string{"state"}, constLabels,
+		),
+		equipmentRaw: prometheus.NewDesc(
+			"ecobee_equipment_status_raw",
+			cfg.help("ecobee_equipment_status_raw", "The equipment status from the thermostat summary as reported by ecobee, a comma-separated list of running equipment. Empty when idle. Includes equipment the exporter doesn't know about."),
+			[]string{"status"}, constLabels,
+		),
+		transitions: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name:        "ecobee_equipment_transitions_total",
+			Help:        cfg.help("ecobee_equipment_transitions_total", "Total number of times equipment turned on or off."),
+			ConstLabels: constLabels,
+		}, []string{"equipment", "to"}),
+		runtimeAge: prometheus.NewDesc(
+			"ecobee_runtime_data_age_seconds",
+			cfg.help("ecobee_runtime_data_age_seconds", "Seconds since the thermostat last reported new runtime data to the ecobee servers."),
+			nil, constLabels,
+		),
+		clockSkew: prometheus.NewDesc(
+			"ecobee_thermostat_clock_skew_seconds",
+			cfg.help("ecobee_thermostat_clock_skew_seconds", "Seconds the thermostat's clock was ahead of the exporter's when the thermostat was last fetched. Negative if it was behind. Large values make schedule and event timings unreliable. Only reported when the thermostat's time zone is known."),
+			nil, constLabels,
+		),
+		cycleDuration: prometheus.NewDesc(
+			"ecobee_equipment_cycle_duration_seconds",
+			cfg.help("ecobee_equipment_cycle_duration_seconds", "How long equipment ran during its last completed cycle, accurate to the scrape interval."),
+			[]string{"equipment"}, constLabels,
+		),
+		shortCycles: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name:        "ecobee_short_cycles_total",
+			Help:        cfg.help("ecobee_short_cycles_total", "Total number of equipment cycles shorter than the short cycle threshold."),
+			ConstLabels: constLabels,
+		}, []string{"equipment"}),
+		lastModified: prometheus.NewDesc(
+			"ecobee_thermostat_last_modified_timestamp_seconds",
+			cfg.help("ecobee_thermostat_last_modified_timestamp_seconds", "Unix timestamp of when the thermostat last modified its configuration."),
+			nil, constLabels,
+		),
+		connectedTime: prometheus.NewDesc(
+			"ecobee_thermostat_connected_timestamp_seconds",
+			cfg.help("ecobee_thermostat_connected_timestamp_seconds", "Unix timestamp of when the thermostat last connected to the ecobee servers."),
+			nil, constLabels,
+		),
+		locationInfo: prometheus.NewDesc(
+			"ecobee_location_info",
+			cfg.help("ecobee_location_info", "Location of the thermostat as configured in ecobee. Always 1."),
+			[]string{"city", "province", "country", "timezone"}, constLabels,
+		),
+		latitude: prometheus.NewDesc(
+			"ecobee_location_latitude",
+			cfg.help("ecobee_location_latitude", "Latitude of the thermostat in degrees."),
+			nil, constLabels,
+		),
+		longitude: prometheus.NewDesc(
+			"ecobee_location_longitude",
+			cfg.help("ecobee_location_longitude", "Longitude of the thermostat in degrees."),
+			nil, constLabels,
+		),
+		reminderOn: prometheus.NewDesc(
+			"ecobee_reminder_enabled",
+			cfg.help("ecobee_reminder_enabled", "1 if the maintenance reminder for a piece of equipment is enabled."),
+			[]string{"type"}, constLabels,
+		),
+		filterLife: prometheus.NewDesc(
+			"ecobee_filter_life_remaining_seconds",
+			cfg.help("ecobee_filter_life_remaining_seconds", "Seconds until the reminder to change a filter is due. Negative once it's overdue."),
+			[]string{"type"}, constLabels,
+		),
+		configuredFound: prometheus.NewDesc(
+			"ecobee_configured_thermostat_found",
+			cfg.help("ecobee_configured_thermostat_found", "1 if the configured thermostat is registered to the authenticated account."),
+			nil, constLabels,
+		),
+	}
+}
+
+func (e *Exporter) Describe(ch chan<- *prometheus.Desc) {
+	e.filter.filterDescs(ch, e.describe)
+}
+
+func (e *Exporter) describe(ch chan<- *prometheus.Desc) {
+	ch <- e.up
+	e.scrapeErrors.Describe(ch)
+	ch <- e.consecFailures
+	e.summaryFetches.Describe(ch)
+	e.fullFetches.Describe(ch)
+	e.callsSaved.Describe(ch)
+	ch <- e.thermostatInfo
+	ch <- e.revisionsInfo
+	ch <- e.rateLimited
+	ch <- e.inMaintenance
+	ch <- e.quotaLimit
+	ch <- e.quotaRemaining
+	ch <- e.insideTemp.desc
+	ch <- e.insideHumidity
+	ch <- e.outsideTemp.desc
+	ch <- e.weatherAvail
+	ch <- e.weatherStation
+	ch <- e.weatherTime
+	ch <- e.desiredHeat.desc
+	ch <- e.desiredCool.desc
+	ch <- e.eventHeat.desc
+	ch <- e.eventCool.desc
+	ch <- e.drActive
+	ch <- e.drHeatOffset.desc
+	ch <- e.drCoolOffset.desc
+	ch <- e.cooling
+	ch <- e.heating
+	ch <- e.coolingStages
+	ch <- e.heatingStages
+	ch <- e.fanRunning
+	ch <- e.auxHeatActive
+	e.auxHeatSeconds.Describe(ch)
+	ch <- e.systemState
+	ch <- e.equipmentRaw
+	e.transitions.Describe(ch)
+	ch <- e.cycleDuration
+	e.shortCycles.Describe(ch)
+	ch <- e.fanRuntime
+	ch <- e.fanMinOn
+	ch <- e.fanSpeed
+	ch <- e.ventRuntime
+	ch <- e.ventMinOn
+	ch <- e.ventType
+	ch <- e.tempCorrection.desc
+	ch <- e.heatRangeLow.desc
+	ch <- e.heatRangeHigh.desc
+	ch <- e.coolRangeLow.desc
+	ch <- e.coolRangeHigh.desc
+	e.settingsMiss.Describe(ch)
+	ch <- e.dehumidWithAC
+	ch <- e.overcoolOffset.desc
+	ch <- e.compMinOutdoor.desc
+	ch <- e.auxMaxOutdoor.desc
+	ch <- e.holdAction
+	ch <- e.homeOccupied
+	ch <- e.sensorTemp.desc
+	ch <- e.sensorOccupied
+	ch <- e.followingSched
+	ch <- e.holdEndsIn
+	ch <- e.climateSensor
+	ch <- e.nextClimate
+	ch <- e.overridden
+	ch <- e.smartRecovery
+	ch <- e.autoAway
+	ch <- e.lastModified
+	ch <- e.connectedTime
+	ch <- e.runtimeAge
+	ch <- e.clockSkew
+	ch <- e.locationInfo
+	ch <- e.reminderOn
+	ch <- e.filterLife
+	ch <- e.latitude
+	ch <- e.longitude
+	ch <- e.configuredFound
+}
+
+func (e *Exporter) Collect(ch chan<- prometheus.Metric) {
+	e.collect(context.Background(), false, ch)
+}
+
+// WithContext returns a Collector for a single scrape that cancels requests
+// to the ecobee API once ctx is done.
+func (e *Exporter) WithContext(ctx context.Context) prometheus.Collector {
+	return &scrapeCollector{e: e, ctx: ctx}
+}
+
+// ForceRefresh returns a Collector for a single scrape like WithContext,
+// but the full thermostat is fetched even if the cached one is still up to
+// date.
+func (e *Exporter) ForceRefresh(ctx context.Context) prometheus.Collector {
+	return &scrapeCollector{e: e, ctx: ctx, force: true}
+}
+
+type scrapeCollector struct {
+	e     *Exporter
+	ctx   context.Context
+	force bool
+}
+
+func (sc *scrapeCollector) Describe(ch chan<- *prometheus.Desc) {
+	sc.e.Describe(ch)
+}
+
+func (sc *scrapeCollector) Collect(ch chan<- prometheus.Metric) {
+	sc.e.collect(sc.ctx, sc.force, ch)
+}
+
+func (e *Exporter) collect(ctx context.Context, force bool, ch chan<- prometheus.Metric) {
+	e.filter.filterMetrics(ch, func(ch chan<- prometheus.Metric) {
+		e.scrape(ctx, force, ch)
+	})
+}
+
+// scrape refreshes the thermostat and emits every metric of the enabled
+// groups. If force is true, the full thermostat is always fetched.
+func (e *Exporter) scrape(ctx context.Context, force bool, ch chan<- prometheus.Metric) {
+	e.mut.Lock()
+	defer e.mut.Unlock()
+
+	if !e.registeredChecked {
+		if err := e.checkRegistered(ctx); err != nil {
+			log.Println("failed to check registered thermostats", err)
+		}
+	}
+	if e.registeredChecked {
+		ch <- prometheus.MustNewConstMetric(e.configuredFound, prometheus.GaugeValue, boolToFloat64(e.registeredFound))
+	}
+
+	// ecobee_up is emitted last so a panic while emitting the other metrics
+	// can still report the scrape as failed.
+	var up float64
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("panic while collecting metrics: %v\n%s", r, debug.Stack())
+			up = 0
+			e.scrapeErrors.Inc()
+		}
+
+		ch <- prometheus.MustNewConstMetric(e.up, prometheus.GaugeValue, up)
+		e.scrapeErrors.Collect(ch)
+		e.recordFailure(up == 1)
+		ch <- prometheus.MustNewConstMetric(e.consecFailures, prometheus.GaugeValue, float64(e.failedScrapes))
+		e.summaryFetches.Collect(ch)
+		e.fullFetches.Collect(ch)
+		e.callsSaved.Collect(ch)
+		e.collectQuota(ch)
+		e.collectMaintenance(ch)
+	}()
+
+	limited := e.rateLimiter != nil && e.rateLimiter.limited()
+	ch <- prometheus.MustNewConstMetric(e.rateLimited, prometheus.GaugeValue, boolToFloat64(limited))
+
+	// The background refresher keeps the thermostat current, so scrapes only
+	// serve the result of its latest refresh unless forced.
+	if e.background && !force {
+		if !e.refreshOK {
+			return
+		}
+	} else if !e.refresh(ctx, force) {
+		return
+	}
+	up = 1
+	e.hasScrapedSuccessfully = true
+	ch <- prometheus.MustNewConstMetric(e.thermostatInfo, prometheus.GaugeValue, 1, e.summary.Name)
+	ch <- prometheus.MustNewConstMetric(e.revisionsInfo, prometheus.GaugeValue, 1,
+		e.summary.RuntimeRevision, e.summary.IntervalRevision, e.summary.ThermostatRevision, e.summary.AlertsRevision)
+
+	// Each group only depends on its own section of the thermostat, so a
+	// section missing from the API response or a group that fails doesn't
+	// stop the other groups from being collected. A group that panics still
+	// fails the scrape.
+	for _, g := range collectorGroups {
+		if !e.collectors[g.name] {
+			continue
+		} else if g.section != "" && !e.thermo.has(g.section) {
+			log.Printf("skipping %s metrics, %s missing from thermostat", g.name, g.section)
+			continue
+		}
+		if !e.collectGroup(ch, g.name, g.collect) {
+			up = 0
+		}
+	}
+}
+
+// collectorGroup collects the metrics of a collector group.
+type collectorGroup struct {
+	name string
+	// section is the section of the thermostat the group needs, if any.
+	section string
+	collect func(e *Exporter, ch chan<- prometheus.Metric)
+}
+
+// collectorGroups are collected in order by every scrape.
+var collectorGroups = []collectorGroup{
+	{collectorTemperature, "runtime", (*Exporter).collectTemperature},
+	{collectorHumidity, "runtime", (*Exporter).collectHumidity},
+	{collectorWeather, "", (*Exporter).collectWeather},
+	{collectorSensors, "remoteSensors", (*Exporter).collectSensors},
+	{collectorEquipment, "", (*Exporter).collectEquipment},
+	{collectorRuntime, "runtime", (*Exporter).collectRuntime},
+	{collectorProgram, "", (*Exporter).collectProgram},
+	{collectorSettings, "", (*Exporter).collectSettings},
+	{collectorExtendedRuntime, "extendedRuntime", (*Exporter).collectExtendedRuntime},
+	{collectorLocation, "location", (*Exporter).collectLocation},
+	{collectorNotifications, "notificationSettings", (*Exporter).collectNotifications},
+}
+
+// refresh refreshes the thermostat, logging and counting failures. e.mut
+// must be held. It returns false if the thermostat couldn't be refreshed.
+func (e *Exporter) refresh(ctx context.Context, force bool) bool {
+	// While rate limited, serve the cached thermostat until the backoff window
+	// has passed.
+	if e.thermo != nil && e.rateLimiter != nil && e.rateLimiter.limited() {
+		// Neither the summary nor the thermostat were requested.
+		e.callsSaved.Add(2)
+		e.changes = refreshChanges{}
+		return true
+	}
+
+	changes, err := e.refreshThermo(ctx, force)
+	if err != nil && e.maintenance != nil && e.maintenance.inMaintenance() {
+		// Maintenance is out of our control, so it isn't a scrape error.
+		log.Println("MAINTENANCE: ecobee API is down for maintenance, failed to refresh thermo", err)
+		return false
+	} else if err != nil {
+		log.Println("failed to refresh thermo", err)
+		e.scrapeErrors.Inc()
+		e.checkThermostatMissing(err)
+		return false
+	}
+	e.changes = changes
+	e.notFoundScrapes = 0
+
+	// Transitions are recorded on every refresh rather than when collecting,
+	// since the background refresher may refresh several times per scrape.
+	if e.collectors[collectorEquipment] {
+		e.recordTransitions()
+	}
+	return true
+}
+
+// backgroundRefresh refreshes the thermostat independent of scrapes. Once
+// it has been called, scrapes serve the thermostat from the latest
+// background refresh instead of refreshing it themselves, and report the
+// thermostat as down while background refreshes fail.
+func (e *Exporter) backgroundRefresh(ctx context.Context) {
+	e.mut.Lock()
+	defer e.mut.Unlock()
+
+	e.background = true
+	e.refreshOK = e.refresh(ctx, false)
+	if e.refreshOK {
+		e.hasScrapedSuccessfully = true
+	}
+}
+
+// recordFailure updates the count of consecutive failed scrapes. Scrapes
+// during ecobee maintenance neither count as failures nor reset the count.
+func (e *Exporter) recordFailure(success bool) {
+	switch {
+	case success:
+		e.failedScrapes = 0
+	case e.maintenance != nil && e.maintenance.inMaintenance():
+	default:
+		e.failedScrapes++
+	}
+}
+
+// checkThermostatMissing exits the process once the thermostat hasn't been
+// found for requireThermoAttempts consecutive scrapes. A thermostat that is
+// never found is almost always a misconfigured ID, which is better surfaced
+// by crashing than by serving empty metrics.
+func (e *Exporter) checkThermostatMissing(err error) {
+	if e.requireThermoAttempts <= 0 || !errors.Is(err, errThermostatNotFound) {
+		return
+	}
+	e.notFoundScrapes++
+	if e.notFoundScrapes >= e.requireThermoAttempts {
+		log.Fatalf("thermostat %q not found in %d consecutive scrapes, exiting", e.thermostatID, e.notFoundScrapes)
+	}
+}
+
+// collectGroup calls collect, recovering from a panic so the remaining
+// groups can still be collected. It returns false if collect panicked.
+func (e *Exporter) collectGroup(ch chan<- prometheus.Metric, name string, collect func(*Exporter, chan<- prometheus.Metric)) (ok bool) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("panic while collecting %s metrics: %v\n%s", name, r, debug.Stack())
+			e.scrapeErrors.Inc()
+			ok = false
+		}
+	}()
+	collect(e, ch)
+	return true
+}
+
+func (e *Exporter) collectQuota(ch chan<- prometheus.Metric) {
+	if e.rateLimiter == nil {
+		return
+	}
+	if limit, remaining, ok := e.rateLimiter.quota(); ok {
+		ch <- prometheus.MustNewConstMetric(e.quotaLimit, prometheus.GaugeValue, limit)
+		ch <- prometheus.MustNewConstMetric(e.quotaRemaining, prometheus.GaugeValue, remaining)
+	}
+}
+
+func (e *Exporter) collectMaintenance(ch chan<- prometheus.Metric) {
+	if e.maintenance == nil {
+		return
+	}
+	ch <- prometheus.MustNewConstMetric(e.inMaintenance, prometheus.GaugeValue, boolToFloat64(e.maintenance.inMaintenance()))
+}
+
+func (e *Exporter) collectTemperature(ch chan<- prometheus.Metric) {
+	e.insideTemp.collect(ch, e.thermo.Runtime.ActualTemperature)
+	e.desiredHeat.collect(ch, e.thermo.Runtime.DesiredHeat)
+	e.desiredCool.collect(ch, e.thermo.Runtime.DesiredCool)
+}
+
+func (e *Exporter) collectHumidity(ch chan<- prometheus.Metric) {
+	ch <- prometheus.MustNewConstMetric(e.insideHumidity, prometheus.GaugeValue, float64(e.thermo.Runtime.ActualHumidity))
+}
+
+func (e *Exporter) collectWeather(ch chan<- prometheus.Metric) {
+	// Weather is occasionally missing. Rather than reporting a stale outside
+	// temperature, stop emitting it until weather data comes back.
+	weatherAvailable := len(e.thermo.Weather.Forecasts) > 0
+	ch <- prometheus.MustNewConstMetric(e.weatherAvail, prometheus.GaugeValue, boolToFloat64(weatherAvailable))
+
+	if station := e.thermo.Weather.WeatherStation; station != "" {
+		ch <- prometheus.MustNewConstMetric(e.weatherStation, prometheus.GaugeValue, 1, station)
+	}
+
+	if weatherAvailable {
+		// ecobee doesn't always return the same number of forecasts, so fall
+		// back to the current conditions if the configured one is missing.
+		idx := e.forecastIndex
+		if idx < 0 || idx >= len(e.thermo.Weather.Forecasts) {
+			idx = 0
+		}
+		forecast := e.thermo.Weather.Forecasts[idx]
+		e.outsideTemp.collect(ch, forecast.Temperature)
+
+		// Forecast times are in the thermostat's local time.
+		observed, err := parseEcobeeTime(forecast.DateTime, e.thermo.timeLocation())
+		if err != nil {
+			log.Println("failed to parse weather forecast dateTime", err)
+		} else if !observed.IsZero() {
+			ch <- prometheus.MustNewConstMetric(e.weatherTime, prometheus.GaugeValue, float64(observed.Unix()))
+		}
+	}
+}
+
+func (e *Exporter) collectSensors(ch chan<- prometheus.Metric) {
+	var (
+		hasOccupancy bool
+		occupied     bool
+	)
+	for _, s := range e.thermo.RemoteSensors {
+		// The thermostat's built-in sensor duplicates the inside temperature,
+		// so it's only reported individually if requested. It still counts
+		// towards occupancy of the home.
+		report := e.includeThermostatSensor || s.Type != "thermostat"
+
+		for _, c := range s.Capability {
+			switch c.Type {
+			case "temperature":
+				tenths, err := strconv.Atoi(c.Value)
+				if err != nil || !report {
+					// ecobee reports "unknown" for sensors that are offline.
+					continue
+				}
+				e.sensorTemp.collect(ch, tenths, s.ID, s.Name)
+			case "occupancy":
+				hasOccupancy = true
+				occupied = occupied || c.Value == "true"
+				if report {
+					ch <- prometheus.MustNewConstMetric(e.sensorOccupied, prometheus.GaugeValue, boolToFloat64(c.Value == "true"), s.ID, s.Name)
+				}
+			}
+		}
+	}
+
+	if hasOccupancy {
+		ch <- prometheus.MustNewConstMetric(e.homeOccupied, prometheus.GaugeValue, boolToFloat64(occupied))
+	}
+}
+
+func (e *Exporter) collectEquipment(ch chan<- prometheus.Metric) {
+	coolStages := []struct {
+		name string
+		on   bool
+	}{
+		{"CompCool1", e.summary.CompCool1},
+		{"CompCool2", e.summary.CompCool2},
+	}
+	var cooling float64
+	for _, st := range coolStages {
+		ch <- prometheus.MustNewConstMetric(e.cooling, prometheus.GaugeValue, boolToFloat64(st.on), st.name)
+		cooling += boolToFloat64(st.on)
+	}
+	ch <- prometheus.MustNewConstMetric(e.coolingStages, prometheus.GaugeValue, cooling)
+
+	heatStages := []struct {
+		name string
+		on   bool
+	}{
+		{"HeatPump", e.summary.HeatPump},
+		{"HeatPump2", e.summary.HeatPump2},
+		{"HeatPump3", e.summary.HeatPump3},
+		{"AuxHeat1", e.summary.AuxHeat1},
+		{"AuxHeat2", e.summary.AuxHeat2},
+		{"AuxHeat3", e.summary.AuxHeat3},
+	}
+	var heating float64
+	for _, st := range heatStages {
+		ch <- prometheus.MustNewConstMetric(e.heating, prometheus.GaugeValue, boolToFloat64(st.on), st.name)
+		heating += boolToFloat64(st.on)
+	}
+	ch <- prometheus.MustNewConstMetric(e.heatingStages, prometheus.GaugeValue, heating)
+
+	ch <- prometheus.MustNewConstMetric(e.fanRunning, prometheus.GaugeValue, boolToFloat64(e.summary.Fan))
+	ch <- prometheus.MustNewConstMetric(e.auxHeatActive, prometheus.GaugeValue, boolToFloat64(e.summary.AuxHeat1 || e.summary.AuxHeat2 || e.summary.AuxHeat3))
+
+	e.transitions.Collect(ch)
+	for name, dur := range e.lastCycle {
+		ch <- prometheus.MustNewConstMetric(e.cycleDuration, prometheus.GaugeValue, dur.Seconds(), name)
+	}
+	e.shortCycles.Collect(ch)
+
+	ch <- prometheus.MustNewConstMetric(e.equipmentRaw, prometheus.GaugeValue, 1, e.summary.RawEquipmentStatus)
+
+	state := systemState(e.summary.EquipmentStatus)
+	for _, s := range systemStates {
+		ch <- prometheus.MustNewConstMetric(e.systemState, prometheus.GaugeValue, boolToFloat64(s == state), s)
+	}
+}
+
+// recordTransitions logs and counts equipment that changed state since the
+// previous refresh. e.mut must be held.
+func (e *Exporter) recordTransitions() {
+	cur := e.summary.EquipmentStatus
+	now := time.Now()
+	defer func() { e.prevEquipment = &cur }()
+	if e.prevEquipment == nil {
+		return
+	}
+
+	prev := equipmentList(*e.prevEquipment)
+	for i, eq := range equipmentList(cur) {
+		if eq.On == prev[i].On {
+			continue
+		}
+		log.Printf("%s turned %s", eq.Name, onOff(eq.On))
+		e.transitions.WithLabelValues(eq.Name, onOff(eq.On)).Inc()
+		e.recordCycle(eq, now)
+	}
+}
+
+// recordCycle tracks how long equipment stays on. Transitions are only seen
+// when scraping, so durations are accurate to the scrape interval. Cycles
+// that started before the exporter did aren't measured.
+func (e *Exporter) recordCycle(eq equipment, now time.Time) {
+	if eq.On {
+		e.equipmentOnSince[eq.Name] = now
+		return
+	}
+
+	since, ok := e.equipmentOnSince[eq.Name]
+	if !ok {
+		return
+	}
+	delete(e.equipmentOnSince, eq.Name)
+
+	dur := now.Sub(since)
+	e.lastCycle[eq.Name] = dur
+	if dur < e.shortCycleThreshold {
+		log.Printf("%s short cycled, ran for %s", eq.Name, dur)
+		e.shortCycles.WithLabelValues(eq.Name).Inc()
+	}
+}
+
+func (e *Exporter) collectRuntime(ch chan<- prometheus.Metric) {
+	// The thermostat's lastModified is reported in the thermostat's local time,
+	// while the runtime timestamps are always UTC.
+	lastModified, err := parseEcobeeTime(e.thermo.LastModified, e.thermo.timeLocation())
+	if err != nil {
+		log.Println("failed to parse thermostat lastModified", err)
+	} else if !lastModified.IsZero() {
+		ch <- prometheus.MustNewConstMetric(e.lastModified, prometheus.GaugeValue, float64(lastModified.Unix()))
+	}
+
+	connected, err := parseEcobeeTime(e.thermo.Runtime.ConnectDateTime, time.UTC)
+	if err != nil {
+		log.Println("failed to parse runtime connectDateTime", err)
+	} else if !connected.IsZero() {
+		ch <- prometheus.MustNewConstMetric(e.connectedTime, prometheus.GaugeValue, float64(connected.Unix()))
+	}
+
+	statusModified, err := parseEcobeeTime(e.thermo.Runtime.LastStatusModified, time.UTC)
+	if err != nil {
+		log.Println("failed to parse runtime lastStatusModified", err)
+	} else if !statusModified.IsZero() {
+		ch <- prometheus.MustNewConstMetric(e.runtimeAge, prometheus.GaugeValue, time.Since(statusModified).Seconds())
+	}
+
+	// The thermostat's time is only comparable to the exporter's once it's
+	// placed in the thermostat's time zone, so it isn't reported if the time
+	// zone is unknown.
+	if loc, err := time.LoadLocation(e.thermo.Location.TimeZone); err == nil && e.thermo.Location.TimeZone != "" {
+		thermoTime, err := parseEcobeeTime(e.thermo.ThermostatTime, loc)
+		if err != nil {
+			log.Println("failed to parse thermostat time", err)
+		} else if !thermoTime.IsZero() {
+			ch <- prometheus.MustNewConstMetric(e.clockSkew, prometheus.GaugeValue, thermoTime.Sub(e.thermoFetched).Seconds())
+		}
+	}
+}
+
+func (e *Exporter) collectProgram(ch chan<- prometheus.Metric) {
+	// Events and the program are separate sections of the thermostat, so
+	// either may be missing independently.
+	if e.thermo.has("events") {
+		ch <- prometheus.MustNewConstMetric(e.followingSched, prometheus.GaugeValue, boolToFloat64(followingSchedule(e.thermo.Events)))
+		ch <- prometheus.MustNewConstMetric(e.autoAway, prometheus.GaugeValue, boolToFloat64(autoAwayActive(e.thermo.Events)))
+
+		// Event times are in the thermostat's wall clock time, like
+		// thermostatNow.
+		if now, err := e.thermostatNow(); err == nil {
+			if end, ok := holdEnd(e.thermo.Events, now); ok {
+				ch <- prometheus.MustNewConstMetric(e.holdEndsIn, prometheus.GaugeValue, end.Sub(now).Seconds())
+			}
+		}
+
+		// The event's hold temperatures are what it intends to hold, which can
+		// briefly differ from the runtime's desired temperatures while the
+		// event is being applied.
+		if ev, ok := holdTempEvent(e.thermo.Events); ok {
+			if !ev.IsHeatOff {
+				e.eventHeat.collect(ch, ev.HeatHoldTemp, ev.Type)
+			}
+			if !ev.IsCoolOff {
+				e.eventCool.collect(ch, ev.CoolHoldTemp, ev.Type)
+			}
+		}
+
+		// Demand response events with absolute setpoints are reported by the
+		// event desired temperatures above.
+		dr, drActive := demandResponseEvent(e.thermo.Events)
+		ch <- prometheus.MustNewConstMetric(e.drActive, prometheus.GaugeValue, boolToFloat64(drActive))
+		if drActive && dr.IsTemperatureRelative {
+			e.drHeatOffset.collect(ch, dr.HeatRelativeTemp)
+			e.drCoolOffset.collect(ch, dr.CoolRelativeTemp)
+		}
+	}
+	if !e.thermo.has("program") {
+		return
+	}
+
+	for _, c := range e.thermo.Program.Climates {
+		for _, s := range c.Sensors {
+			ch <- prometheus.MustNewConstMetric(e.climateSensor, prometheus.GaugeValue, 1, c.Name, climateSensorID(s.ID))
+		}
+	}
+
+	now, err := e.thermostatNow()
+	if err != nil {
+		log.Println("failed to parse thermostat time", err)
+		return
+	}
+
+	if ref, in, ok := nextClimateChange(e.thermo.Program.Schedule, now); ok {
+		ch <- prometheus.MustNewConstMetric(e.nextClimate, prometheus.GaugeValue, in.Seconds(), ref)
+	}
+
+	// Holds and other events can run a climate other than the scheduled one.
+	// Events that only adjust setpoints keep the current climate ref.
+	if ref, ok := scheduledClimate(e.thermo.Program.Schedule, now); ok && e.thermo.Program.CurrentClimateRef != "" {
+		ch <- prometheus.MustNewConstMetric(e.overridden, prometheus.GaugeValue, boolToFloat64(ref != e.thermo.Program.CurrentClimateRef))
+	}
+
+	// Smart Recovery can only be told apart from events that change the
+	// desired temperatures when the events were fetched.
+	if e.thermo.has("events") && e.thermo.has("runtime") {
+		var pre *settings
+		if e.thermo.has("settings") {
+			pre = &e.thermo.Settings
+		}
+		ch <- prometheus.MustNewConstMetric(e.smartRecovery, prometheus.GaugeValue, boolToFloat64(smartRecoveryActive(e.thermo, pre)))
+	}
+}
+
+func (e *Exporter) collectSettings(ch chan<- prometheus.Metric) {
+	// ecobee intermittently returns the settings missing or with every field
+	// empty. Report nothing rather than misleading zeros until they're back.
+	defer e.settingsMiss.Collect(ch)
+	if !e.thermo.has("settings") || e.thermo.Settings == (settings{}) {
+		log.Println("skipping settings metrics, settings missing from thermostat")
+		e.settingsMiss.Inc()
+		return
+	}
+
+	ch <- prometheus.MustNewConstMetric(e.fanMinOn, prometheus.GaugeValue, float64(e.thermo.Settings.FanMinOnTime)/60.0)
+	if speed := e.thermo.Settings.FanSpeed; speed != "" {
+		ch <- prometheus.MustNewConstMetric(e.fanSpeed, prometheus.GaugeValue, 1, speed)
+	}
+
+	e.tempCorrection.collect(ch, e.thermo.Settings.TempCorrection)
+
+	s := e.thermo.Settings
+	e.heatRangeLow.collect(ch, s.HeatRangeLow)
+	e.heatRangeHigh.collect(ch, s.HeatRangeHigh)
+	e.coolRangeLow.collect(ch, s.CoolRangeLow)
+	e.coolRangeHigh.collect(ch, s.CoolRangeHigh)
+
+	ch <- prometheus.MustNewConstMetric(e.dehumidWithAC, prometheus.GaugeValue, boolToFloat64(s.DehumidifyWithAC))
+	e.overcoolOffset.collect(ch, s.DehumidifyOvercoolOffset)
+
+	e.compMinOutdoor.collect(ch, s.CompressorProtectionMinTemp)
+	e.auxMaxOutdoor.collect(ch, s.AuxMaxOutdoorTemp)
+
+	if s.HoldAction != "" {
+		ch <- prometheus.MustNewConstMetric(e.holdAction, prometheus.GaugeValue, 1, s.HoldAction)
+	}
+
+	ch <- prometheus.MustNewConstMetric(e.ventMinOn, prometheus.GaugeValue, float64(s.VentilatorMinOnTime))
+	if s.VentilatorType != "" {
+		ch <- prometheus.MustNewConstMetric(e.ventType, prometheus.GaugeValue, 1, s.VentilatorType)
+	}
+}
+
+// extendedRuntimeInterval is the length of each interval reported in
+// ExtendedRuntime.
+const extendedRuntimeInterval = 5 * time.Minute
+
+func (e *Exporter) collectExtendedRuntime(ch chan<- prometheus.Metric) {
+	if frac, ok := runtimeFraction(e.thermo.ExtendedRuntime.Fan); ok {
+		ch <- prometheus.MustNewConstMetric(e.fanRuntime, prometheus.GaugeValue, frac)
+	}
+	if frac, ok := runtimeFraction(e.thermo.ExtendedRuntime.Ventilator); ok {
+		ch <- prometheus.MustNewConstMetric(e.ventRuntime, prometheus.GaugeValue, frac)
+	}
+
+	e.recordAuxHeat()
+	e.auxHeatSeconds.Collect(ch)
+}
+
+// runtimeFraction returns the fraction of time equipment ran given the
+// seconds it ran in each extended runtime interval. ecobee only reports the
+// last three 5-minute intervals, so the fraction covers the last 15 minutes
+// rather than a full hour. Returns false if there are no intervals.
+func runtimeFraction(intervals []int) (float64, bool) {
+	if len(intervals) == 0 {
+		return 0, false
+	}
+	var ran int
+	for _, secs := range intervals {
+		ran += secs
+	}
+	period := extendedRuntimeInterval.Seconds() * float64(len(intervals))
+	return float64(ran) / period, true
+}
+
+// recordAuxHeat adds the aux heat runtime of extended runtime intervals that
+// haven't been counted yet. Each interval is only counted once, even though
+// it's reported by three consecutive readings.
+func (e *Exporter) recordAuxHeat() {
+	er := e.thermo.ExtendedRuntime
+	last, err := parseEcobeeTime(er.LastReadingTimestamp, time.UTC)
+	if err != nil || last.IsZero() {
+		return
+	}
+
+	intervals := len(er.AuxHeat1)
+	if len(er.AuxHeat2) != intervals || len(er.AuxHeat3) != intervals {
+		return
+	}
+
+	// Only the intervals after the last one already counted are new.
+	start := 0
+	if !e.auxHeatCounted.IsZero() {
+		if !last.After(e.auxHeatCounted) {
+			return
+		}
+		if n := int(last.Sub(e.auxHeatCounted) / extendedRuntimeInterval); n < intervals {
+			start = intervals - n
+		}
+	}
+
+	var secs int
+	for i := start; i < intervals; i++ {
+		secs += er.AuxHeat1[i] + er.AuxHeat2[i] + er.AuxHeat3[i]
+	}
+	e.auxHeatSeconds.Add(float64(secs))
+	e.auxHeatCounted = last
+}
+
+func (e *Exporter) collectLocation(ch chan<- prometheus.Metric) {
+	l := e.thermo.Location
+	ch <- prometheus.MustNewConstMetric(e.locationInfo, prometheus.GaugeValue, 1, l.City, l.ProvinceState, l.Country, l.TimeZone)
+
+	if lat, long, ok := l.coordinates(); ok {
+		ch <- prometheus.MustNewConstMetric(e.latitude, prometheus.GaugeValue, lat)
+		ch <- prometheus.MustNewConstMetric(e.longitude, prometheus.GaugeValue, long)
+	}
+}
+
+func (e *Exporter) collectNotifications(ch chan<- prometheus.Metric) {
+	for _, r := range e.thermo.NotificationSettings.Equipment {
+		ch <- prometheus.MustNewConstMetric(e.reminderOn, prometheus.GaugeValue, boolToFloat64(r.Enabled), r.Type)
+
+		// Filter types are named like furnaceFilter or humidifierFilter.
+		if !r.Enabled || r.RemindMeDate == "" || !strings.HasSuffix(strings.ToLower(r.Type), "filter") {
+			continue
+		}
+		due, err := time.ParseInLocation(ecobeeDateLayout, r.RemindMeDate, e.thermo.timeLocation())
+		if err != nil {
+			log.Printf("failed to parse remindMeDate of %s reminder: %s", r.Type, err)
+			continue
+		}
+		ch <- prometheus.MustNewConstMetric(e.filterLife, prometheus.GaugeValue, time.Until(due).Seconds(), r.Type)
+	}
+}
+
+// Ready returns true once the exporter has successfully retrieved the
+// thermostat from the ecobee API at least once.
+func (e *Exporter) Ready() bool {
+	e.mut.Lock()
+	defer e.mut.Unlock()
+	return e.hasScrapedSuccessfully
+}
+
+// ThermostatID returns the ID of the thermostat being scraped.
+func (e *Exporter) ThermostatID() string {
+	return e.thermostatID
+}
+
+// setpoints are the desired temperatures of a thermostat and the ranges
+// they may be set within, in tenths of a degree Fahrenheit. The ranges are
+// zero when thermostat settings aren't being fetched.
+type setpoints struct {
+	DesiredHeat, DesiredCool    int
+	HeatRangeLow, HeatRangeHigh int
+	CoolRangeLow, CoolRangeHigh int
+}
+
+// Setpoints returns the desired temperatures of the thermostat from the
+// most recent scrape. ok is false if the thermostat hasn't been fetched yet.
+func (e *Exporter) Setpoints() (sp setpoints, ok bool) {
+	e.mut.Lock()
+	defer e.mut.Unlock()
+	if e.thermo == nil {
+		return setpoints{}, false
+	}
+	s := e.thermo.Settings
+	return setpoints{
+		DesiredHeat:   e.thermo.Runtime.DesiredHeat,
+		DesiredCool:   e.thermo.Runtime.DesiredCool,
+		HeatRangeLow:  s.HeatRangeLow,
+		HeatRangeHigh: s.HeatRangeHigh,
+		CoolRangeLow:  s.CoolRangeLow,
+		CoolRangeHigh: s.CoolRangeHigh,
+	}, true
+}
+
+// TimeLocation returns the time zone of the thermostat from the most recent
+// scrape. ok is false if the thermostat hasn't been scraped yet.
+func (e *Exporter) TimeLocation() (loc *time.Location, ok bool) {
+	e.mut.Lock()
+	defer e.mut.Unlock()
+	if e.thermo == nil {
+		return nil, false
+	}
+	return e.thermo.timeLocation(), true
+}
+
+// thermostatNow returns the current wall clock time of the thermostat. The
+// time reported by the thermostat when it was fetched is advanced by the
+// time since the fetch.
+func (e *Exporter) thermostatNow() (time.Time, error) {
+	t, err := parseEcobeeTime(e.thermo.ThermostatTime, time.UTC)
+	if err != nil {
+		return time.Time{}, err
+	} else if t.IsZero() {
+		return time.Time{}, fmt.Errorf("thermostat did not report its time")
+	}
+	return t.Add(time.Since(e.thermoFetched)), nil
+}
+
+// checkRegistered verifies that the configured thermostat is registered to
+// the account the exporter is authenticated as. A thermostat that isn't
+// registered will never return any data. e.mut must be held.
+func (e *Exporter) checkRegistered(ctx context.Context) error {
+	registered, err := getRegisteredThermostats(ctx, e.cli)
+	if err != nil {
+		return err
+	}
+	e.recordRegistered(registered)
+	return nil
+}
+
+// setRegistered records whether the thermostat is in registered, the
+// thermostats registered to the account.
+func (e *Exporter) setRegistered(registered map[string]ecobee.ThermostatSummary) {
+	e.mut.Lock()
+	defer e.mut.Unlock()
+	e.recordRegistered(registered)
+}
+
+// recordRegistered is setRegistered without locking. e.mut must be held.
+func (e *Exporter) recordRegistered(registered map[string]ecobee.ThermostatSummary) {
+	_, found := registered[e.thermostatID]
+	if !found {
+		log.Printf("thermostat %q is not registered to the authenticated account", e.thermostatID)
+	}
+	e.registeredChecked = true
+	e.registeredFound = found
+}
+
+// runtimeUpdateInterval is how often ecobee thermostats report new runtime
+// data. A thermostat fetched longer ago than this almost certainly has a
+// stale runtime revision.
+const runtimeUpdateInterval = 3 * time.Minute
+
+// refreshChanges describes what changed when the thermostat was refreshed.
+type refreshChanges struct {
+	// summary is true if the runtime revision in the summary differs from
+	// the previous summary.
+	summary bool
+
+	// fullFetch is true if the cached thermostat was replaced by a newly
+	// fetched one.
+	fullFetch bool
+}
+
+// refreshThermo updates the cached summary and, if needed, the cached
+// thermostat. All fields of the returned changes are true the first time
+// the thermostat is refreshed.
+func (e *Exporter) refreshThermo(ctx context.Context, force bool) (refreshChanges, error) {
+	var (
+		g          errgroup.Group
+		summary    *thermostatSummary
+		fetched    *thermostat
+		fetchedErr error
+	)
+
+	// When the cached thermostat is likely to be stale, fetch the full
+	// thermostat at the same time as the summary instead of waiting for the
+	// summary to tell us the revision changed.
+	speculative := e.thermo == nil || time.Since(e.thermoFetched) > runtimeUpdateInterval
+
+	// Fields outside of the runtime, like weather and events, don't bump the
+	// runtime revision. Optionally refetch the thermostat periodically so they
+	// don't go stale.
+	forceFull := force || (e.fullFetchInterval > 0 && time.Since(e.thermoFetched) >= e.fullFetchInterval)
+	speculative = speculative || forceFull
+	if speculative {
+		e.fullFetches.Inc()
+		g.Go(func() error {
+			fetched, fetchedErr = getThermostat(ctx, e.cli, e.thermostatID, e.collectors)
+			return nil
+		})
+	}
+	e.summaryFetches.Inc()
+	g.Go(func() error {
+		var err error
+		summary, err = getThermostatSummary(ctx, e.cli, e.thermostatID)
+		return err
+	})
+	if err := g.Wait(); err != nil {
+		return refreshChanges{}, fmt.Errorf("failed refreshing thermo: %w", err)
+	}
+
+	var changes refreshChanges
+	if prev := e.summary; prev == nil {
+		changes.summary = true
+	} else {
+		changes.summary = summary.RuntimeRevision != prev.RuntimeRevision
+	}
+
+	if e.thermo == nil || summary.RuntimeRevision != e.thermo.Runtime.RuntimeRev || forceFull {
+		if forceFull {
+			log.Println("full fetch forced, updating thermo object")
+		} else {
+			log.Println("runtime revision changed, updating thermo object")
+		}
+
+		t, err := fetched, fetchedErr
+		if !speculative || (err == nil && t.Runtime.RuntimeRev != summary.RuntimeRevision) {
+			// Either nothing was fetched or the revision changed again between the
+			// two calls; fetch the thermostat now.
+			e.fullFetches.Inc()
+			t, err = getThermostat(ctx, e.cli, e.thermostatID, e.collectors)
+		}
+		if err != nil {
+			return refreshChanges{}, fmt.Errorf("failed getting updated thermostat: %w", err)
+		}
+
+		e.thermo = t
+		e.thermoFetched = time.Now()
+		changes.fullFetch = true
+	} else if speculative && fetchedErr == nil && fetched.Runtime.RuntimeRev == summary.RuntimeRevision {
+		// The revision didn't change, but keep the speculative fetch anyway.
+		// Otherwise the cached thermostat stays old and every later refresh
+		// fetches it speculatively again.
+		e.thermo = fetched
+		e.thermoFetched = time.Now()
+		changes.fullFetch = true
+	} else if !speculative {
+		// The summary showed the cached thermostat is current.
+		e.callsSaved.Inc()
+	}
+
+	// The summary is only kept once the thermostat is current so the next
+	// refresh's changes are relative to the last successful one.
+	e.summary = summary
+	return changes, nil
+}
+
+func boolToFloat64(v bool) float64 {
+	if v {
+		return 1.0
+	}
+	return 0.0
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/rspier/go-ecobee/ecobee"
+)
+
+// fakeTransport serves canned ecobee API responses, like selfTestTransport
+// but with a thermostat response chosen by the test.
+type fakeTransport struct {
+	summary    string
+	thermostat string
+}
+
+func (t fakeTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	var body string
+	switch req.URL.Path {
+	case "/1/thermostatSummary":
+		body = t.summary
+	case "/1/thermostat":
+		body = t.thermostat
+	default:
+		return nil, fmt.Errorf("unexpected request to %s", req.URL)
+	}
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Status:     "200 OK",
+		Header:     http.Header{"Content-Type": []string{"application/json"}},
+		Body:       ioutil.NopCloser(strings.NewReader(body)),
+		Request:    req,
+	}, nil
+}
+
+// fixtureThermostat returns the self-test thermostat response after passing
+// the fixture thermostat to modify.
+func fixtureThermostat(t *testing.T, modify func(thermostat map[string]interface{})) string {
+	t.Helper()
+
+	var resp struct {
+		ThermostatList []map[string]interface{} `json:"thermostatList"`
+		Status         ecobee.Status            `json:"status"`
+	}
+	if err := json.Unmarshal([]byte(selfTestThermostat), &resp); err != nil {
+		t.Fatal(err)
+	}
+	modify(resp.ThermostatList[0])
+
+	bb, err := json.Marshal(resp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(bb)
+}
+
+// scrapeFixture scrapes an Exporter for the self-test thermostat that is
+// served thermostatResp, with the same collectors as the self-test.
+func scrapeFixture(t *testing.T, thermostatResp string) []*dto.MetricFamily {
+	t.Helper()
+
+	collectors, err := parseCollectors(defaultCollectors + "," + collectorSettings)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cli := &ecobee.Client{Client: &http.Client{Transport: fakeTransport{
+		summary:    selfTestSummary,
+		thermostat: thermostatResp,
+	}}}
+	e := NewExporter(cli, ExporterConfig{
+		ThermostatID:    selfTestThermostatID,
+		Collectors:      collectors,
+		TemperatureUnit: unitFahrenheit,
+	})
+
+	mfs, err := scrapeOnce(ioutil.Discard, e)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return mfs
+}
+
+func TestCollectWeather_NoForecasts(t *testing.T) {
+	mfs := scrapeFixture(t, fixtureThermostat(t, func(thermostat map[string]interface{}) {
+		thermostat["weather"] = map[string]interface{}{"forecasts": []interface{}{}}
+	}))
+
+	if v, ok := findMetric(mfs, "ecobee_weather_available", nil); !ok || v != 0 {
+		t.Errorf("ecobee_weather_available = %v (found %v), want 0", v, ok)
+	}
+	if _, ok := findMetric(mfs, "ecobee_outside_temperature", nil); ok {
+		t.Error("ecobee_outside_temperature emitted without forecasts")
+	}
+	if v, _ := findMetric(mfs, "ecobee_up", nil); v != 1 {
+		t.Errorf("ecobee_up = %v, want 1", v)
+	}
+}
+
+func TestScrape_GroupPanic(t *testing.T) {
+	groups := collectorGroups
+	defer func() { collectorGroups = groups }()
+	collectorGroups = append([]collectorGroup{{
+		name:    collectorTemperature,
+		collect: func(*Exporter, chan<- prometheus.Metric) { panic("deliberate panic") },
+	}}, groups...)
+
+	mfs := scrapeFixture(t, selfTestThermostat)
+
+	if v, ok := findMetric(mfs, "ecobee_up", nil); !ok || v != 0 {
+		t.Errorf("ecobee_up = %v (found %v), want 0", v, ok)
+	}
+	if v, _ := findMetric(mfs, "ecobee_scrape_errors_total", nil); v != 1 {
+		t.Errorf("ecobee_scrape_errors_total = %v, want 1", v)
+	}
+	// The groups after the panicking one are still collected.
+	if _, ok := findMetric(mfs, "ecobee_outside_temperature", nil); !ok {
+		t.Error("ecobee_outside_temperature not emitted after a group panicked")
+	}
+}
+
+func TestScrape_MissingSections(t *testing.T) {
+	tt := []struct {
+		name    string
+		missing string
+		// absent are metrics of the group needing the missing section.
+		absent []string
+		// present are metrics of other groups, which must still be emitted.
+		present []string
+	}{
+		{
+			name:    "runtime",
+			missing: "runtime",
+			absent:  []string{"ecobee_inside_temperature", "ecobee_inside_humidity"},
+			present: []string{"ecobee_outside_temperature", "ecobee_sensor_temperature", "ecobee_temperature_correction"},
+		},
+		{
+			name:    "remote sensors",
+			missing: "remoteSensors",
+			absent:  []string{"ecobee_sensor_temperature", "ecobee_sensor_occupied"},
+			present: []string{"ecobee_inside_temperature", "ecobee_outside_temperature", "ecobee_temperature_correction"},
+		},
+		{
+			name:    "weather",
+			missing: "weather",
+			absent:  []string{"ecobee_outside_temperature"},
+			present: []string{"ecobee_inside_temperature", "ecobee_sensor_temperature", "ecobee_temperature_correction"},
+		},
+		{
+			name:    "settings",
+			missing: "settings",
+			absent:  []string{"ecobee_temperature_correction", "ecobee_heat_range_low"},
+			present: []string{"ecobee_inside_temperature", "ecobee_outside_temperature", "ecobee_sensor_temperature"},
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			mfs := scrapeFixture(t, fixtureThermostat(t, func(thermostat map[string]interface{}) {
+				delete(thermostat, tc.missing)
+			}))
+
+			if v, _ := findMetric(mfs, "ecobee_up", nil); v != 1 {
+				t.Errorf("ecobee_up = %v, want 1", v)
+			}
+			for _, name := range tc.absent {
+				if _, ok := findMetric(mfs, name, nil); ok {
+					t.Errorf("%s emitted without %s", name, tc.missing)
+				}
+			}
+			for _, name := range tc.present {
+				if _, ok := findMetric(mfs, name, nil); !ok {
+					t.Errorf("%s not emitted without %s", name, tc.missing)
+				}
+			}
+		})
+	}
+}
+
+func TestGetThermostat(t *testing.T) {
+	// ecobee sometimes responds with other thermostats on the account
+	// alongside the requested one.
+	resp := `{
+		"thermostatList": [
+			{"identifier": "111111111111", "name": "Other", "runtime": {"actualTemperature": 650}},
+			{"identifier": "123456789012", "name": "Fixture", "runtime": {"actualTemperature": 712}},
+			{"identifier": "222222222222", "name": "Another", "runtime": {"actualTemperature": 800}}
+		],
+		"status": {"code": 0, "message": ""}
+	}`
+	cli := &ecobee.Client{Client: &http.Client{Transport: fakeTransport{thermostat: resp}}}
+	collectors := collectorSet{collectorTemperature: true}
+
+	t.Run("selects by identifier", func(t *testing.T) {
+		got, err := getThermostat(context.Background(), cli, "123456789012", collectors)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.Identifier != "123456789012" || got.Name != "Fixture" || got.Runtime.ActualTemperature != 712 {
+			t.Errorf("got thermostat %s (%s) at %d, want 123456789012 (Fixture) at 712",
+				got.Identifier, got.Name, got.Runtime.ActualTemperature)
+		}
+	})
+
+	t.Run("not found", func(t *testing.T) {
+		_, err := getThermostat(context.Background(), cli, "333333333333", collectors)
+		if !errors.Is(err, errThermostatNotFound) {
+			t.Errorf("got error %v, want errThermostatNotFound", err)
+		}
+	})
+}
+
+// TestRecordTransitions_BackgroundRefresh checks that transitions between
+// background refreshes are counted even if a later refresh before the scrape
+// didn't change the equipment status.
+func TestRecordTransitions_BackgroundRefresh(t *testing.T) {
+	statuses := []string{"compCool1,fan", "fan", "fan"}
+	var refreshes int
+	cli := &ecobee.Client{Client: &http.Client{Transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		ft := fakeTransport{thermostat: selfTestThermostat}
+		if req.URL.Path == "/1/thermostatSummary" {
+			// Further requests, such as the scrape's, see the last status.
+			status := statuses[len(statuses)-1]
+			if refreshes < len(statuses) {
+				status = statuses[refreshes]
+			}
+			ft.summary = strings.Replace(selfTestSummary, "compCool1,fan", status, 1)
+			refreshes++
+		}
+		return ft.RoundTrip(req)
+	})}}
+	e := NewExporter(cli, ExporterConfig{
+		ThermostatID:    selfTestThermostatID,
+		Collectors:      collectorSet{collectorEquipment: true},
+		TemperatureUnit: unitFahrenheit,
+	})
+
+	for range statuses {
+		e.backgroundRefresh(context.Background())
+	}
+
+	mfs, err := scrapeOnce(ioutil.Discard, e)
+	if err != nil {
+		t.Fatal(err)
+	}
+	labels := map[string]string{"equipment": "compCool1", "to": "off"}
+	if v, ok := findMetric(mfs, "ecobee_equipment_transitions_total", labels); !ok || v != 1 {
+		t.Errorf("ecobee_equipment_transitions_total%v = %v (found %v), want 1", labels, v, ok)
+	}
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rspier/go-ecobee/ecobee"
+)
+
+// exporterSet scrapes several thermostats, with one Exporter for each. Every
+// metric of an Exporter is labeled with its thermostat ID, so the set can be
+// collected as a single target.
+type exporterSet struct {
+	cli *ecobee.Client
+	// cfg configures every Exporter in the set except for its ThermostatID.
+	cfg ExporterConfig
+
+	mut       sync.Mutex
+	exporters []*Exporter
+}
+
+// newExporterSet creates an exporterSet that scrapes the thermostats with
+// the given IDs.
+func newExporterSet(cli *ecobee.Client, cfg ExporterConfig, ids []string) *exporterSet {
+	s := &exporterSet{cli: cli, cfg: cfg}
+	s.SetThermostatIDs(ids)
+	return s
+}
+
+// SetThermostatIDs changes the thermostats being scraped. Exporters of
+// thermostats that are still scraped keep their state; cached state about
+// thermostats that are no longer scraped is discarded. Repeated IDs are
+// only scraped once.
+func (s *exporterSet) SetThermostatIDs(ids []string) {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+
+	prev := make(map[string]*Exporter, len(s.exporters))
+	for _, e := range s.exporters {
+		prev[e.ThermostatID()] = e
+	}
+
+	ids = dedupeThermostatIDs(ids)
+	exporters := make([]*Exporter, 0, len(ids))
+	for _, id := range ids {
+		if e, ok := prev[id]; ok {
+			exporters = append(exporters, e)
+			continue
+		}
+		cfg := s.cfg
+		cfg.ThermostatID = id
+		exporters = append(exporters, NewExporter(s.cli, cfg))
+	}
+	s.exporters = exporters
+}
+
+// Exporters returns the Exporter of each scraped thermostat.
+func (s *exporterSet) Exporters() []*Exporter {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	return append([]*Exporter(nil), s.exporters...)
+}
+
+// Exporter returns the Exporter of the thermostat with the given ID. ok is
+// false if the thermostat isn't scraped.
+func (s *exporterSet) Exporter(id string) (e *Exporter, ok bool) {
+	for _, e := range s.Exporters() {
+		if e.ThermostatID() == id {
+			return e, true
+		}
+	}
+	return nil, false
+}
+
+// fromRequest returns the Exporter of the thermostat named by the
+// thermostat_id query parameter of r. The parameter may be omitted when only
+// one thermostat is scraped.
+func (s *exporterSet) fromRequest(r *http.Request) (*Exporter, error) {
+	id := r.URL.Query().Get("thermostat_id")
+	if id == "" {
+		exporters := s.Exporters()
+		if len(exporters) != 1 {
+			return nil, fmt.Errorf("thermostat_id must be set when %d thermostats are scraped", len(exporters))
+		}
+		return exporters[0], nil
+	}
+	e, ok := s.Exporter(id)
+	if !ok {
+		return nil, fmt.Errorf("thermostat %s is not configured", id)
+	}
+	return e, nil
+}
+
+// Ready returns true once every thermostat has been successfully retrieved
+// from the ecobee API at least once.
+func (s *exporterSet) Ready() bool {
+	for _, e := range s.Exporters() {
+		if !e.Ready() {
+			return false
+		}
+	}
+	return true
+}
+
+// checkRegistered verifies that every thermostat is registered to the
+// account the exporter is authenticated as. The registered thermostats are
+// retrieved once for the whole set.
+func (s *exporterSet) checkRegistered(ctx context.Context) error {
+	registered, err := getRegisteredThermostats(ctx, s.cli)
+	if err != nil {
+		return err
+	}
+	for _, e := range s.Exporters() {
+		e.setRegistered(registered)
+	}
+	return nil
+}
+
+// RunRefresher refreshes every thermostat every interval until ctx is
+// canceled, independent of scrapes. See (*Exporter).backgroundRefresh.
+func (s *exporterSet) RunRefresher(ctx context.Context, interval time.Duration) {
+	for {
+		refreshCtx, cancel := context.WithTimeout(ctx, interval)
+		var wg sync.WaitGroup
+		for _, e := range s.Exporters() {
+			wg.Add(1)
+			go func(e *Exporter) {
+				defer wg.Done()
+				e.backgroundRefresh(refreshCtx)
+			}(e)
+		}
+		wg.Wait()
+		cancel()
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+	}
+}
+
+// Describe implements prometheus.Collector. Nothing is described, which
+// makes the set an unchecked collector: the thermostats, and so the
+// thermostat_id labels of the metrics, can change after the set is
+// registered.
+func (s *exporterSet) Describe(chan<- *prometheus.Desc) {}
+
+func (s *exporterSet) Collect(ch chan<- prometheus.Metric) {
+	s.collect(context.Background(), false, ch)
+}
+
+// WithContext returns a Collector for a single scrape of every thermostat
+// that cancels requests to the ecobee API once ctx is done.
+func (s *exporterSet) WithContext(ctx context.Context) prometheus.Collector {
+	return &setCollector{s: s, ctx: ctx}
+}
+
+// ForceRefresh returns a Collector for a single scrape like WithContext,
+// but the full thermostats are fetched even if the cached ones are still up
+// to date.
+func (s *exporterSet) ForceRefresh(ctx context.Context) prometheus.Collector {
+	return &setCollector{s: s, ctx: ctx, force: true}
+}
+
+// collect scrapes every thermostat concurrently.
+func (s *exporterSet) collect(ctx context.Context, force bool, ch chan<- prometheus.Metric) {
+	var wg sync.WaitGroup
+	for _, e := range s.Exporters() {
+		wg.Add(1)
+		go func(e *Exporter) {
+			defer wg.Done()
+			e.collect(ctx, force, ch)
+		}(e)
+	}
+	wg.Wait()
+}
+
+type setCollector struct {
+	s     *exporterSet
+	ctx   context.Context
+	force bool
+}
+
+func (sc *setCollector) Describe(chan<- *prometheus.Desc) {}
+
+func (sc *setCollector) Collect(ch chan<- prometheus.Metric) {
+	sc.s.collect(sc.ctx, sc.force, ch)
+}
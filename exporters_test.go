@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/rspier/go-ecobee/ecobee"
+)
+
+// newFixtureSet returns an exporterSet for ids that is served the self-test
+// fixtures. registeredCalls counts the requests for the registered
+// thermostats.
+func newFixtureSet(t *testing.T, ids ...string) (s *exporterSet, registeredCalls *int64) {
+	t.Helper()
+
+	collectors, err := parseCollectors(defaultCollectors)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	registeredCalls = new(int64)
+	cli := &ecobee.Client{Client: &http.Client{Transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		if strings.Contains(req.URL.Query().Get("json"), `"registered"`) {
+			atomic.AddInt64(registeredCalls, 1)
+		}
+		return selfTestTransport{}.RoundTrip(req)
+	})}}
+	s = newExporterSet(cli, ExporterConfig{
+		Collectors:      collectors,
+		TemperatureUnit: unitFahrenheit,
+	}, ids)
+	return s, registeredCalls
+}
+
+func TestExporterSet_CheckRegistered(t *testing.T) {
+	const unregisteredID = "222222222222"
+	s, registeredCalls := newFixtureSet(t, selfTestThermostatID, unregisteredID)
+
+	if err := s.checkRegistered(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if n := atomic.LoadInt64(registeredCalls); n != 1 {
+		t.Errorf("registered thermostats requested %d times, want 1", n)
+	}
+
+	mfs, err := scrapeOnce(ioutil.Discard, s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for id, want := range map[string]float64{selfTestThermostatID: 1, unregisteredID: 0} {
+		got, ok := findMetric(mfs, "ecobee_configured_thermostat_found", map[string]string{"thermostat_id": id})
+		if !ok || got != want {
+			t.Errorf("ecobee_configured_thermostat_found{thermostat_id=%q} = %v (found %v), want %v", id, got, ok, want)
+		}
+	}
+}
+
+// TestExporterSet_CheckRegisteredDuringScrape checks registration while
+// the thermostats are being scraped, as main does once the server is
+// running. Run with -race to catch unsynchronized access.
+func TestExporterSet_CheckRegisteredDuringScrape(t *testing.T) {
+	s, _ := newFixtureSet(t, selfTestThermostatID)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := scrapeOnce(ioutil.Discard, s); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		if err := s.checkRegistered(context.Background()); err != nil {
+			t.Error(err)
+		}
+	}()
+	wg.Wait()
+}
+
+func TestExporterSet_DuplicateIDs(t *testing.T) {
+	s, _ := newFixtureSet(t, selfTestThermostatID, selfTestThermostatID)
+	if n := len(s.Exporters()); n != 1 {
+		t.Fatalf("got %d exporters, want 1", n)
+	}
+
+	s.SetThermostatIDs([]string{selfTestThermostatID, selfTestThermostatID})
+	if n := len(s.Exporters()); n != 1 {
+		t.Fatalf("got %d exporters after SetThermostatIDs, want 1", n)
+	}
+
+	// Duplicate series would make gathering fail.
+	if _, err := scrapeOnce(ioutil.Discard, s); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// metricFilter decides which metrics the exporter emits by name. A nil
+// metricFilter allows every metric.
+type metricFilter struct {
+	allow map[string]bool
+	deny  map[string]bool
+}
+
+// parseMetricFilter parses comma-separated lists of metric names to allow
+// and deny. If allow is empty, every metric not in deny is allowed. Returns
+// nil if both lists are empty.
+func parseMetricFilter(allow, deny string) *metricFilter {
+	f := &metricFilter{allow: nameSet(allow), deny: nameSet(deny)}
+	if len(f.allow) == 0 && len(f.deny) == 0 {
+		return nil
+	}
+	return f
+}
+
+func nameSet(s string) map[string]bool {
+	set := map[string]bool{}
+	for _, name := range strings.Split(s, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			set[name] = true
+		}
+	}
+	return set
+}
+
+func (f *metricFilter) allowed(name string) bool {
+	if f == nil {
+		return true
+	}
+	return (len(f.allow) == 0 || f.allow[name]) && !f.deny[name]
+}
+
+// filterDescs calls describe, forwarding the descriptors of allowed metrics
+// to ch.
+func (f *metricFilter) filterDescs(ch chan<- *prometheus.Desc, describe func(chan<- *prometheus.Desc)) {
+	if f == nil {
+		describe(ch)
+		return
+	}
+
+	inner := make(chan *prometheus.Desc)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for d := range inner {
+			if f.allowed(descName(d)) {
+				ch <- d
+			}
+		}
+	}()
+	describe(inner)
+	close(inner)
+	<-done
+}
+
+// filterMetrics calls collect, forwarding allowed metrics to ch.
+func (f *metricFilter) filterMetrics(ch chan<- prometheus.Metric, collect func(chan<- prometheus.Metric)) {
+	if f == nil {
+		collect(ch)
+		return
+	}
+
+	inner := make(chan prometheus.Metric)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for m := range inner {
+			if f.allowed(descName(m.Desc())) {
+				ch <- m
+			}
+		}
+	}()
+	collect(inner)
+	close(inner)
+	<-done
+}
+
+var fqNameRegexp = regexp.MustCompile(`fqName: "([^"]*)"`)
+
+// descName returns the metric name of d. prometheus.Desc doesn't expose the
+// name directly, so it's taken from the string form of d.
+func descName(d *prometheus.Desc) string {
+	m := fqNameRegexp.FindStringSubmatch(d.String())
+	if m == nil {
+		return ""
+	}
+	return m[1]
+}
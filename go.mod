@@ -3,8 +3,15 @@ module github.com/rfratto/ecobee_exporter
 go 1.15
 
 require (
+	cloud.google.com/go/storage v1.12.0
+	github.com/aws/aws-sdk-go v1.36.0
 	github.com/gorilla/mux v1.8.0
 	github.com/prometheus/client_golang v1.7.1
+	github.com/prometheus/client_model v0.2.0
+	github.com/prometheus/common v0.10.0
 	github.com/rspier/go-ecobee v0.0.0-20201001045826-171fa1acecfb
 	golang.org/x/oauth2 v0.0.0-20201208152858-08078c50e5b5
+	golang.org/x/sync v0.0.0-20200625203802-6e8e738ad208
+	google.golang.org/api v0.32.0
+	gopkg.in/yaml.v2 v2.2.8
 )
@@ -1,49 +1,312 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"syscall"
+	"time"
+	_ "time/tzdata" // Thermostat time zones are needed to parse ecobee timestamps.
 
 	"github.com/gorilla/mux"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/prometheus/common/expfmt"
 	"github.com/rfratto/ecobee_exporter/ecobeeauth"
 	"github.com/rspier/go-ecobee/ecobee"
 	"golang.org/x/oauth2"
+	"gopkg.in/yaml.v2"
 )
 
 // flags
 var (
 	flagAPIKey       = flag.String("api-key", "", "ecobee API key")
 	flagCacheFile    = flag.String("cache-file", "/tmp/ecobee-cache.json", "ecobee oauth cache")
-	flagThermostatID = flag.String("thermostat-id", "", "ecobee thermostat ID to scrape")
-	flagListenAddr   = flag.String("listen-addr", ":8080", "port to expose metrics on")
+	flagCacheDirMode = flag.String("cache-dir-mode", fmt.Sprintf("%o", ecobeeauth.DefaultDirMode), "octal mode used to create the directory of -cache-file if it doesn't exist")
+	flagTokenStore   = flag.String("token-store", "file", "where to store the ecobee oauth token (file, s3, gcs, or memory to not persist it across restarts)")
+	flagTokenURI     = flag.String("token-store-uri", "", "location of the token for the s3 and gcs token stores (e.g., s3://bucket/key)")
+	flagThermostatID = flag.String("thermostat-id", "", "comma-separated ecobee thermostat IDs to scrape")
+	flagIDFile       = flag.String("thermostat-id-file", "", "file to read the thermostat IDs to scrape from, separated by commas or newlines, reloaded on SIGHUP")
+	flagRequireTherm = flag.Bool("require-thermostat", false, "exit if the thermostat isn't found in -require-thermostat-attempts consecutive scrapes, to surface a wrong thermostat ID")
+	flagRequireTries = flag.Int("require-thermostat-attempts", 3, "consecutive scrapes that may fail to find the thermostat when -require-thermostat is set")
+	flagListenAddr   = flag.String("listen-addr", ":8080", "address to expose metrics on ([host]:port or unix:///path/to/socket)")
+	flagReadHdrTO    = flag.Duration("http-read-header-timeout", 10*time.Second, "maximum time to read the headers of a request, limiting slow clients holding connections open (0 for no limit)")
+	flagReadTO       = flag.Duration("http-read-timeout", 30*time.Second, "maximum time to read an entire request (0 for no limit)")
+	flagWriteTO      = flag.Duration("http-write-timeout", 2*time.Minute, "maximum time to write a response, which includes calling the ecobee API during a scrape (0 for no limit)")
+	flagIdleTO       = flag.Duration("http-idle-timeout", 2*time.Minute, "maximum time to keep an idle keep-alive connection open (0 to use -http-read-timeout)")
+	flagRoutePrefix  = flag.String("route-prefix", "", "path prefix that all endpoints are served under, for serving behind a reverse proxy at a sub-path (e.g., /ecobee)")
+	flagMaxScrapes   = flag.Int("max-concurrent-scrapes", 0, "maximum number of /metrics requests served at once; more respond with 503 (0 for no limit)")
+	flagRequireToken = flag.Bool("require-token", false, "respond to /metrics with 503 until an ecobee token is available")
+	flagAPICallLimit = flag.Int("api-call-limit", 0, "requests per hour ecobee allows, used to estimate the remaining quota when ecobee doesn't send rate limit headers (0 to disable)")
+	flagTempUnit     = flag.String("temperature-unit", string(unitFahrenheit), "unit to report temperatures in (fahrenheit, celsius, or both to report each temperature in both units with a unit label)")
+	flagTempPrec     = flag.Int("temperature-precision", -1, "number of decimal places to round temperatures to (negative to not round)")
+	flagCollectors   = flag.String("collectors", defaultCollectors, "comma-separated list of metric groups to enable")
+	flagThermRefresh = flag.Duration("thermostat-refresh-interval", 0, "refresh the thermostat in the background this often, independent of scrapes, which then serve the latest refreshed thermostat (0 to refresh on every scrape)")
+	flagFullFetch    = flag.Duration("full-fetch-interval", 0, "refetch the full thermostat at least this often even if its runtime revision is unchanged, keeping weather and events fresh (0 to only refetch on revision changes)")
+	flagAllowlist    = flag.String("metric-allowlist", "", "comma-separated list of metric names to emit; all metrics are emitted if empty")
+	flagDenylist     = flag.String("metric-denylist", "", "comma-separated list of metric names to never emit")
+	flagForecastIdx  = flag.Int("weather-forecast-index", 0, "index of the ecobee weather forecast that ecobee_outside_temperature is taken from (0 is the current conditions)")
+	flagShortCycle   = flag.Duration("short-cycle-threshold", 5*time.Minute, "equipment cycles shorter than this are counted in ecobee_short_cycles_total")
+	flagHelpFile     = flag.String("help-overrides-file", "", "YAML file mapping metric names to help text that replaces the built-in help")
+	flagThermSensor  = flag.Bool("include-thermostat-sensor", false, "report the thermostat's built-in sensor in the per-sensor metrics")
+	flagEnableWrite  = flag.Bool("enable-write", false, "expose /control endpoints that modify the thermostat")
+	flagControlToken = flag.String("control-auth-token", "", "bearer token required by the /control endpoints")
+	flagTransferTok  = flag.String("token-transfer-auth-token", "", "bearer token required by /auth-export and /auth-import, which expose the ecobee refresh token; the endpoints are disabled if empty")
+	flagAuthURL      = flag.String("ecobee-auth-url", ecobeeauth.Endpoint.AuthURL, "URL of the ecobee pin authorization endpoint")
+	flagTokenURL     = flag.String("ecobee-token-url", ecobeeauth.Endpoint.TokenURL, "URL of the ecobee token endpoint")
+	flagExpirySkew   = flag.Duration("token-expiry-skew", time.Minute, "how much earlier than ecobee reports new tokens expire they are treated as expired, to allow for slow networks and clock skew")
+	flagRefreshWarn  = flag.Duration("refresh-token-warn-age", 300*24*time.Hour, "age of the ecobee authorization after which ecobee_refresh_token_expiry_warning is set, since refresh tokens expire about a year after the pin flow")
+	flagMaxRespSize  = flag.Int64("max-response-size", 10<<20, "largest response body in bytes read from the ecobee API and authorization endpoints")
+	flagBGRefresh    = flag.Bool("background-token-refresh", false, "refresh the ecobee token in the background before it expires")
+	flagRefreshAhead = flag.Duration("token-refresh-before", 5*time.Minute, "how long before expiry the background refresher refreshes the token")
+	flagRefreshJit   = flag.Duration("token-refresh-jitter", time.Minute, "maximum random time added to -token-refresh-before to spread out refreshes of shared tokens")
+	flagValidate     = flag.Bool("validate", false, "scrape the thermostat once, print the metrics, and exit")
+	flagPushURL      = flag.String("push-gateway-url", "", "URL of a Pushgateway to periodically push metrics to")
+	flagPushInterval = flag.Duration("push-interval", runtimeUpdateInterval, "how often to push metrics to -push-gateway-url; the default matches how often ecobee thermostats report new runtime data")
+	flagPushAlign    = flag.Bool("push-align", false, "push to -push-gateway-url at wall clock multiples of -push-interval instead of relative to when the exporter started")
+	flagPushJob      = flag.String("push-job", "ecobee_exporter", "job label used when pushing to -push-gateway-url")
+	flagPushInstance = flag.String("push-instance", "", "instance label used when pushing to -push-gateway-url")
+	flagMetricsExp   = flag.String("metrics-exporter", metricsExporterPrometheus, "how metrics are exported (prometheus to serve /metrics, otlp to send them to -otlp-endpoint)")
+	flagOTLPEndpoint = flag.String("otlp-endpoint", "http://localhost:4318/v1/metrics", "OTLP/HTTP metrics endpoint used when -metrics-exporter is otlp")
+	flagOTLPInterval = flag.Duration("otlp-interval", time.Minute, "how often to send metrics to -otlp-endpoint")
+	flagOTLPHeaders  = flag.String("otlp-header", "", "comma-separated key=value headers sent with every request to -otlp-endpoint (e.g., Authorization=Bearer token)")
+	flagWaitToken    = flag.Duration("wait-for-token", 0, "how long to wait at startup for a valid token to appear in the token store before scraping (0 to not wait)")
+	flagOneshot      = flag.Bool("oneshot", false, "scrape the thermostat and token metrics once, write them to stdout, and exit")
+	flagSelfTest     = flag.Bool("self-test", false, "scrape a built-in fixture thermostat without calling the ecobee API, check that values are scaled correctly, and exit")
 )
 
 func main() {
 	flag.Parse()
+	if *flagSelfTest {
+		if err := selfTest(os.Stdout); err != nil {
+			log.Fatalln("self-test failed:", err)
+		}
+		fmt.Println("PASS")
+		return
+	}
 	if *flagAPIKey == "" {
 		log.Fatalln("required flag unset: -api-key")
-	} else if *flagThermostatID == "" {
-		log.Fatalln("required flag unset: -thermostat-id")
+	} else if *flagThermostatID == "" && *flagIDFile == "" {
+		log.Fatalln("required flag unset: -thermostat-id or -thermostat-id-file")
+	} else if *flagThermostatID != "" && *flagIDFile != "" {
+		log.Fatalln("-thermostat-id and -thermostat-id-file are mutually exclusive")
+	} else if *flagEnableWrite && *flagControlToken == "" {
+		log.Fatalln("-control-auth-token must be set when -enable-write is used")
+	} else if *flagForecastIdx < 0 {
+		log.Fatalln("-weather-forecast-index must not be negative")
+	} else if *flagRequireTherm && *flagRequireTries <= 0 {
+		log.Fatalln("-require-thermostat-attempts must be positive")
+	} else if *flagMaxRespSize <= 0 {
+		log.Fatalln("-max-response-size must be positive")
+	} else if *flagMaxScrapes < 0 {
+		log.Fatalln("-max-concurrent-scrapes must not be negative")
+	} else if *flagExpirySkew < 0 {
+		log.Fatalln("-token-expiry-skew must not be negative")
+	} else if *flagThermRefresh < 0 {
+		log.Fatalln("-thermostat-refresh-interval must not be negative")
+	}
+
+	collectors, err := parseCollectors(*flagCollectors)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	tempUnit, err := parseTemperatureUnit(*flagTempUnit)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	var helpOverrides map[string]string
+	if *flagHelpFile != "" {
+		helpOverrides, err = readHelpOverrides(*flagHelpFile)
+		if err != nil {
+			log.Fatalln(err)
+		}
+	}
+
+	var thermostatIDs []string
+	if *flagIDFile != "" {
+		thermostatIDs, err = readThermostatIDs(*flagIDFile)
+	} else {
+		thermostatIDs, err = parseThermostatIDs(*flagThermostatID)
+	}
+	if err != nil {
+		log.Fatalln(err)
+	} else if len(thermostatIDs) == 0 {
+		log.Fatalln("-thermostat-id must contain at least one thermostat ID")
+	}
+	if err := validateEndpointURL("-ecobee-auth-url", *flagAuthURL); err != nil {
+		log.Fatalln(err)
+	}
+	if err := validateEndpointURL("-ecobee-token-url", *flagTokenURL); err != nil {
+		log.Fatalln(err)
+	}
+	listenAddr, err := normalizeListenAddr(*flagListenAddr)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	routePrefix, err := normalizeRoutePrefix(*flagRoutePrefix)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	otlpHeaders, err := parseOTLPHeaders(*flagOTLPHeaders)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	switch *flagMetricsExp {
+	case metricsExporterPrometheus:
+	case metricsExporterOTLP:
+		if err := validateEndpointURL("-otlp-endpoint", *flagOTLPEndpoint); err != nil {
+			log.Fatalln(err)
+		} else if *flagOTLPInterval <= 0 {
+			log.Fatalln("-otlp-interval must be positive")
+		}
+	default:
+		log.Fatalf("unknown -metrics-exporter %q, must be one of prometheus, otlp", *flagMetricsExp)
+	}
+	if *flagPushURL != "" {
+		if err := validateEndpointURL("-push-gateway-url", *flagPushURL); err != nil {
+			log.Fatalln(err)
+		} else if *flagPushInterval <= 0 {
+			log.Fatalln("-push-interval must be positive")
+		}
 	}
 
-	ts, err := ecobeeauth.NewTokenSource(*flagAPIKey, *flagCacheFile)
+	store, err := newTokenStore(context.Background(), *flagTokenStore, *flagTokenURI)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	ts, err := ecobeeauth.NewTokenSource(context.Background(), *flagAPIKey, store,
+		ecobeeauth.WithEndpoint(oauth2.Endpoint{
+			AuthURL:  *flagAuthURL,
+			TokenURL: *flagTokenURL,
+		}),
+		ecobeeauth.WithExpirySkew(*flagExpirySkew),
+		ecobeeauth.WithMaxResponseSize(*flagMaxRespSize),
+		ecobeeauth.WithRequiredScopes(requiredScopes(*flagEnableWrite)...),
+	)
 	if err != nil {
 		log.Fatalln(err)
 	}
-	cli := &ecobee.Client{Client: oauth2.NewClient(context.Background(), ts)}
+	maintenance := newMaintenanceTransport(&bodyLimitTransport{base: http.DefaultTransport, max: *flagMaxRespSize})
+	rateLimiter := newRateLimitTransport(&tokenTransport{ts: ts, base: maintenance}, *flagAPICallLimit)
+	httpClient := &http.Client{Transport: rateLimiter}
+	cli := &ecobee.Client{Client: httpClient}
+
+	var requireAttempts int
+	if *flagRequireTherm {
+		requireAttempts = *flagRequireTries
+	}
+
+	exporters := newExporterSet(cli, ExporterConfig{
+		Collectors:      collectors,
+		TemperatureUnit: tempUnit,
+		RateLimiter:     rateLimiter,
+		Maintenance:     maintenance,
+
+		TemperaturePrecision:      *flagTempPrec,
+		IncludeThermostatSensor:   *flagThermSensor,
+		HelpOverrides:             helpOverrides,
+		FullFetchInterval:         *flagFullFetch,
+		MetricFilter:              parseMetricFilter(*flagAllowlist, *flagDenylist),
+		WeatherForecastIndex:      *flagForecastIdx,
+		ShortCycleThreshold:       *flagShortCycle,
+		RequireThermostatAttempts: requireAttempts,
+	}, thermostatIDs)
+
+	if *flagValidate {
+		if err := validate(os.Stdout, ts, exporters); err != nil {
+			log.Fatalln("validation failed:", err)
+		}
+		return
+	}
+	if *flagOneshot {
+		if err := oneshot(os.Stdout, ts, exporters); err != nil {
+			log.Fatalln("scrape failed:", err)
+		}
+		return
+	}
+
+	prometheus.MustRegister(newTokenCollector(ts))
+	prometheus.MustRegister(configInfo(collectors, tempUnit, len(thermostatIDs)))
+	prometheus.MustRegister(startTime(time.Now()))
+
+	root := mux.NewRouter()
+	r := root
+	if routePrefix != "" {
+		r = root.PathPrefix(routePrefix).Subrouter()
+	}
+	if *flagMetricsExp == metricsExporterPrometheus {
+		limit := newInFlightLimiter(*flagMaxScrapes)
+		prometheus.MustRegister(limit.inFlight)
+		r.Handle("/metrics", limit.wrap(metricsHandler(ts, exporters, *flagRequireToken)))
+		r.Handle("/metrics/{thermostatID}", limit.wrap(thermostatMetricsHandler(ts, exporters, *flagRequireToken)))
+	}
+
+	// /refresh fetches the full thermostats immediately and responds with the
+	// resulting metrics. When write mode is enabled, it requires the same
+	// bearer token as the /control endpoints.
+	refresh := refreshHandler(exporters)
+	if *flagEnableWrite {
+		refresh = requireBearer(*flagControlToken)(refresh)
+	}
+	r.Handle("/refresh", refresh).Methods(http.MethodPost)
+
+	// /thermostats lists the thermostats registered to the account.
+	r.Handle("/thermostats", thermostatsHandler(cli)).Methods(http.MethodGet)
+
+	// /healthz reports that the process is running.
+	r.HandleFunc("/healthz", func(rw http.ResponseWriter, r *http.Request) {
+		rw.WriteHeader(http.StatusOK)
+	})
 
-	exporter := NewExporter(cli, *flagThermostatID)
-	prometheus.MustRegister(exporter)
+	// /readyz reports whether the exporter has successfully scraped every
+	// thermostat at least once.
+	r.HandleFunc("/readyz", func(rw http.ResponseWriter, r *http.Request) {
+		if !exporters.Ready() {
+			http.Error(rw, "thermostats have not all been scraped successfully yet", http.StatusServiceUnavailable)
+			return
+		}
+		rw.WriteHeader(http.StatusOK)
+	})
 
-	r := mux.NewRouter()
-	r.Handle("/metrics", promhttp.Handler())
+	// /auth-status reports the state of the current token, including the
+	// scopes it was granted and any required scopes it is missing.
+	r.HandleFunc("/auth-status", func(rw http.ResponseWriter, r *http.Request) {
+		tok := ts.CachedToken()
+		status := struct {
+			Valid          bool       `json:"valid"`
+			Expiry         *time.Time `json:"expiry,omitempty"`
+			Scopes         []string   `json:"scopes,omitempty"`
+			MissingScopes  []string   `json:"missing_scopes,omitempty"`
+			ReAuthRequired bool       `json:"reauth_required"`
+		}{
+			Valid:          tok.Valid(),
+			MissingScopes:  ts.MissingScopes(),
+			ReAuthRequired: ts.ReAuthRequired(),
+		}
+		if tok != nil {
+			status.Expiry = &tok.Expiry
+			status.Scopes = ecobeeauth.TokenScopes(tok)
+		}
+		rw.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(rw).Encode(status)
+	}).Methods(http.MethodGet)
 
 	// /auth-start initates an pin code authorization
 	r.HandleFunc("/auth-start", func(rw http.ResponseWriter, r *http.Request) {
@@ -62,7 +325,8 @@ func main() {
 	// /auth-validate finishes a pin code authorization. An Authorization header
 	// must be set with a Bearer token set to the value of "code" from the response
 	// of the /auth-start flow. If the application hasn't been validated on Ecobee's
-	// site yet, this call will fail.
+	// site yet, this call returns 202 Accepted and should be retried later. If the
+	// pin expired, it returns 410 Gone and /auth-start must be called again.
 	r.HandleFunc("/auth-validate", func(rw http.ResponseWriter, r *http.Request) {
 		authHeader := r.Header.Get("Authorization")
 		if authHeader == "" {
@@ -72,7 +336,14 @@ func main() {
 		authHeader = strings.TrimPrefix(authHeader, "Bearer ")
 
 		tok, err := ts.GetToken(r.Context(), authHeader)
-		if err != nil {
+		switch {
+		case errors.Is(err, ecobeeauth.ErrAuthorizationPending):
+			http.Error(rw, err.Error(), http.StatusAccepted)
+			return
+		case errors.Is(err, ecobeeauth.ErrPinExpired):
+			http.Error(rw, err.Error(), http.StatusGone)
+			return
+		case err != nil:
 			http.Error(rw, err.Error(), http.StatusBadRequest)
 			return
 		}
@@ -85,191 +356,558 @@ func main() {
 		rw.WriteHeader(http.StatusOK)
 	}).Methods(http.MethodPost)
 
-	log.Println("listening on", *flagListenAddr)
-	err = http.ListenAndServe(*flagListenAddr, r)
+	if *flagTransferTok != "" {
+		registerTokenTransferRoutes(r, ts, *flagTransferTok)
+	}
+	if *flagEnableWrite {
+		registerControlRoutes(r, cli, exporters, *flagControlToken)
+	}
+
+	// ctx is canceled on SIGINT or SIGTERM, which stops the background
+	// goroutines and the server together.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go cancelOnSignal(ctx, cancel, os.Interrupt, syscall.SIGTERM)
+
+	l, err := listen(listenAddr)
 	if err != nil {
 		log.Fatalln("failed to listen", err)
 	}
+	log.Println("listening on", listenAddr)
+	srv := newHTTPServer(root)
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- srv.Serve(l)
+	}()
+
+	// The server is already running so /healthz is available while waiting.
+	// /readyz reports 503 until a scrape succeeds, which needs the token.
+	if *flagWaitToken > 0 {
+		if err := waitForToken(ctx, ts, *flagWaitToken); err != nil {
+			log.Println("continuing without a token:", err)
+		}
+	}
+
+	if err := exporters.checkRegistered(ctx); err != nil {
+		log.Println("could not verify thermostats are registered to the account, will retry on scrape:", err)
+	}
+
+	// Every background goroutine is tracked so shutdown can wait for them,
+	// letting a token refresh finish saving the new token.
+	var wg sync.WaitGroup
+	start := func(f func()) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			f()
+		}()
+	}
+	if *flagThermRefresh > 0 {
+		start(func() { exporters.RunRefresher(ctx, *flagThermRefresh) })
+	}
+	if *flagBGRefresh {
+		start(func() { ts.RunRefresher(ctx, *flagRefreshAhead, *flagRefreshJit) })
+	}
+	if *flagMetricsExp == metricsExporterOTLP {
+		start(func() { runOTLPExporter(ctx, *flagOTLPEndpoint, otlpHeaders, *flagOTLPInterval, ts, exporters) })
+	}
+	if *flagPushURL != "" {
+		start(func() {
+			runPusher(ctx, *flagPushURL, *flagPushJob, *flagPushInstance, *flagPushInterval, *flagPushAlign, ts, exporters)
+		})
+	}
+	if *flagIDFile != "" {
+		start(func() { reloadThermostatIDsOnSIGHUP(ctx, *flagIDFile, exporters) })
+	}
+
+	select {
+	case err := <-serveErr:
+		log.Fatalln("failed to serve", err)
+	case <-ctx.Done():
+	}
+
+	log.Println("shutting down")
+	shutdownCtx, cancelShutdown := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancelShutdown()
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		log.Println("failed to shut down server:", err)
+	}
+	if !waitGroupDone(shutdownCtx, &wg) {
+		log.Fatalln("background goroutines did not stop within", shutdownTimeout)
+	}
 }
 
-func getThermostat(c *ecobee.Client, thermostatID string) (*ecobee.Thermostat, error) {
-	s := ecobee.Selection{
-		SelectionType:  "thermostats",
-		SelectionMatch: thermostatID,
-
-		IncludeAlerts:          false,
-		IncludeEvents:          true,
-		IncludeProgram:         true,
-		IncludeRuntime:         true,
-		IncludeExtendedRuntime: false,
-		IncludeSettings:        false,
-		IncludeSensors:         true,
-		IncludeWeather:         true,
-	}
-	thermostats, err := c.GetThermostats(s)
-	if err != nil {
-		return nil, err
-	} else if len(thermostats) != 1 {
-		return nil, fmt.Errorf("got %d thermostats, wanted 1", len(thermostats))
+// shutdownTimeout is how long shutting down waits for in-flight requests and
+// background goroutines to finish.
+const shutdownTimeout = 30 * time.Second
+
+// cancelOnSignal calls cancel once one of sigs is received or ctx is
+// canceled.
+func cancelOnSignal(ctx context.Context, cancel context.CancelFunc, sigs ...os.Signal) {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, sigs...)
+	defer signal.Stop(sig)
+
+	select {
+	case s := <-sig:
+		log.Println("received", s)
+		cancel()
+	case <-ctx.Done():
+	}
+}
+
+// waitGroupDone waits for wg. It returns false if ctx is canceled first.
+func waitGroupDone(ctx context.Context, wg *sync.WaitGroup) bool {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// newHTTPServer returns a server for h with the timeouts set by the
+// -http-*-timeout flags. Without timeouts, clients that send requests slowly
+// or never read responses can hold connections open indefinitely and
+// exhaust the exporter's file descriptors.
+//
+// The write timeout must be long enough for a scrape to finish, since
+// scraping calls the ecobee API before the response is written.
+func newHTTPServer(h http.Handler) *http.Server {
+	return &http.Server{
+		Handler:           h,
+		ReadHeaderTimeout: *flagReadHdrTO,
+		ReadTimeout:       *flagReadTO,
+		WriteTimeout:      *flagWriteTO,
+		IdleTimeout:       *flagIdleTO,
 	}
-	return &thermostats[0], nil
 }
 
-func getThermostatSummary(c *ecobee.Client, thermostatID string) (*ecobee.ThermostatSummary, error) {
-	tss, err := c.GetThermostatSummary(ecobee.Selection{
-		SelectionType:  "thermostats",
-		SelectionMatch: thermostatID,
-
-		IncludeEquipmentStatus: true,
-		IncludeAlerts:          false,
-		IncludeEvents:          true,
-		IncludeProgram:         true,
-		IncludeRuntime:         true,
-		IncludeExtendedRuntime: false,
-		IncludeSettings:        false,
-		IncludeSensors:         true,
-		IncludeWeather:         true,
+// Bounds of the backoff between checks for a token in waitForToken.
+const (
+	minTokenWaitBackoff = time.Second
+	maxTokenWaitBackoff = 30 * time.Second
+)
+
+// waitForToken waits up to timeout for ts to have a valid token, reloading
+// it from the token store with exponential backoff. This smooths over the
+// store becoming available after the process starts, such as a volume
+// being mounted late or another process finishing re-authorization.
+func waitForToken(ctx context.Context, ts *ecobeeauth.TokenSource, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	backoff := minTokenWaitBackoff
+	for {
+		// TokenWithContext refreshes the token if it has expired, which is
+		// just as good as finding a new one.
+		if tok := ts.CachedToken(); tok != nil {
+			if _, err := ts.TokenWithContext(ctx); err == nil {
+				return nil
+			}
+		}
+
+		log.Println("waiting for ecobee token, checking again in", backoff)
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("no valid token after %s", timeout)
+		case <-time.After(backoff):
+		}
+
+		if err := ts.Reload(ctx); err != nil {
+			log.Println("failed to reload token:", err)
+		}
+		if backoff *= 2; backoff > maxTokenWaitBackoff {
+			backoff = maxTokenWaitBackoff
+		}
+	}
+}
+
+// configInfo returns a metric describing the effective configuration of the
+// exporter. Secrets like the API key and tokens must never be included.
+func configInfo(collectors collectorSet, unit temperatureUnit, thermostats int) prometheus.Gauge {
+	var pushInterval string
+	if *flagPushURL != "" {
+		pushInterval = flagPushInterval.String()
+	}
+
+	g := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "ecobee_exporter_config_info",
+		Help: "Effective configuration of the exporter. Always 1.",
+		ConstLabels: prometheus.Labels{
+			"collectors":               collectors.String(),
+			"temperature_unit":         string(unit),
+			"thermostats":              strconv.Itoa(thermostats),
+			"full_fetch_interval":      flagFullFetch.String(),
+			"token_store":              *flagTokenStore,
+			"metrics_exporter":         *flagMetricsExp,
+			"write_enabled":            strconv.FormatBool(*flagEnableWrite),
+			"background_token_refresh": strconv.FormatBool(*flagBGRefresh),
+			"push_interval":            pushInterval,
+		},
+	})
+	g.Set(1)
+	return g
+}
+
+// startTime returns a metric holding when the exporter started, so its
+// uptime is known even if the process collector is disabled.
+func startTime(t time.Time) prometheus.Gauge {
+	g := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "ecobee_exporter_start_time_seconds",
+		Help: "Unix timestamp of when the exporter started.",
 	})
+	g.Set(float64(t.Unix()))
+	return g
+}
+
+// readHelpOverrides reads a YAML mapping of metric names to help text.
+func readHelpOverrides(path string) (map[string]string, error) {
+	bb, err := ioutil.ReadFile(path)
 	if err != nil {
-		return nil, fmt.Errorf("failed getting thermostat summary: %w", err)
+		return nil, fmt.Errorf("failed to read help overrides: %w", err)
 	}
+	var overrides map[string]string
+	if err := yaml.UnmarshalStrict(bb, &overrides); err != nil {
+		return nil, fmt.Errorf("failed to parse help overrides %s: %w", path, err)
+	}
+	return overrides, nil
+}
+
+// reloadThermostatIDsOnSIGHUP re-reads the thermostat ID file each time the
+// process receives SIGHUP, until ctx is canceled. Errors are logged and the
+// previous IDs are kept.
+func reloadThermostatIDsOnSIGHUP(ctx context.Context, path string, exporters *exporterSet) {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGHUP)
+	defer signal.Stop(sig)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-sig:
+		}
 
-	summary, ok := tss[thermostatID]
-	if !ok {
-		return nil, fmt.Errorf("thermostat not found in summary")
+		ids, err := readThermostatIDs(path)
+		if err != nil {
+			log.Println("failed to reload thermostat IDs, keeping previous IDs:", err)
+			continue
+		}
+		log.Println("reloaded thermostat IDs", strings.Join(ids, ","))
+		exporters.SetThermostatIDs(ids)
 	}
-	return &summary, nil
 }
 
-type Exporter struct {
-	cli          *ecobee.Client
-	thermo       *ecobee.Thermostat
-	summary      *ecobee.ThermostatSummary
-	thermostatID string
-
-	insideTemp     prometheus.Gauge
-	insideHumidity prometheus.Gauge
-	outsideTemp    prometheus.Gauge
-	desiredHeat    prometheus.Gauge
-	desiredCool    prometheus.Gauge
-	cooling        *prometheus.GaugeVec
-	heating        *prometheus.GaugeVec
-	fanRunning     prometheus.Gauge
+// metricsHandler returns the handler for /metrics. If requireToken is true,
+// the handler responds with 503 until ts has a token so the exporter
+// doesn't look like a healthy target without any ecobee data.
+//
+// The thermostats are collected with the context of the scrape request, so
+// calls to the ecobee API are abandoned once Prometheus gives up on the
+// scrape.
+func metricsHandler(ts *ecobeeauth.TokenSource, exporters *exporterSet, requireToken bool) http.Handler {
+	h := promhttp.InstrumentMetricHandler(prometheus.DefaultRegisterer, http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		ctx, cancel := scrapeContext(r)
+		defer cancel()
+
+		reg := prometheus.NewRegistry()
+		reg.MustRegister(exporters.WithContext(ctx))
+
+		gatherers := prometheus.Gatherers{prometheus.DefaultGatherer, reg}
+		promhttp.HandlerFor(gatherers, promhttp.HandlerOpts{}).ServeHTTP(rw, r)
+	}))
+	if !requireToken {
+		return h
+	}
+	return withRequiredToken(ts, h)
 }
 
-func NewExporter(cli *ecobee.Client, thermostatID string) *Exporter {
-	return &Exporter{
-		cli:          cli,
-		thermostatID: thermostatID,
+// thermostatMetricsHandler returns the handler for /metrics/{thermostatID}.
+// Only the metrics of that thermostat are served, without the exporter's own
+// process and token metrics, so each thermostat can be scraped as its own
+// target. Unknown thermostat IDs respond with 404.
+func thermostatMetricsHandler(ts *ecobeeauth.TokenSource, exporters *exporterSet, requireToken bool) http.Handler {
+	h := http.Handler(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		id := mux.Vars(r)["thermostatID"]
+		exporter, ok := exporters.Exporter(id)
+		if !ok {
+			http.Error(rw, fmt.Sprintf("thermostat %s is not configured", id), http.StatusNotFound)
+			return
+		}
 
-		insideTemp: prometheus.NewGauge(prometheus.GaugeOpts{
-			Name: "ecobee_inside_temperature",
-			Help: "Indoor temperature.",
-		}),
-		insideHumidity: prometheus.NewGauge(prometheus.GaugeOpts{
-			Name: "ecobee_inside_humidity",
-			Help: "Indoor humidity",
-		}),
-		outsideTemp: prometheus.NewGauge(prometheus.GaugeOpts{
-			Name: "ecobee_outside_temperature",
-			Help: "Outside temperature.",
-		}),
-		desiredHeat: prometheus.NewGauge(prometheus.GaugeOpts{
-			Name: "ecobee_desired_heat",
-			Help: "Desired minimum temperature to heat to.",
-		}),
-		desiredCool: prometheus.NewGauge(prometheus.GaugeOpts{
-			Name: "ecobee_desired_cool",
-			Help: "Desired maximum temperature to cool to.",
-		}),
-		cooling: prometheus.NewGaugeVec(prometheus.GaugeOpts{
-			Name: "ecobee_cooling_stage",
-			Help: "Stage of compressors for cooling that are running",
-		}, []string{"stage"}),
-		heating: prometheus.NewGaugeVec(prometheus.GaugeOpts{
-			Name: "ecobee_heating_stage",
-			Help: "Stage of pumps for heating that are running",
-		}, []string{"stage"}),
-		fanRunning: prometheus.NewGauge(prometheus.GaugeOpts{
-			Name: "ecobee_fan_running",
-			Help: "1 if the fan is running",
-		}),
+		ctx, cancel := scrapeContext(r)
+		defer cancel()
+
+		reg := prometheus.NewRegistry()
+		reg.MustRegister(exporter.WithContext(ctx))
+		promhttp.HandlerFor(reg, promhttp.HandlerOpts{}).ServeHTTP(rw, r)
+	}))
+	if !requireToken {
+		return h
 	}
+	return withRequiredToken(ts, h)
+}
+
+// withRequiredToken responds with 503 until ts has a token so the exporter
+// doesn't look like a healthy target without any ecobee data.
+func withRequiredToken(ts *ecobeeauth.TokenSource, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if ts.CachedToken() == nil {
+			http.Error(rw, "no ecobee token available, run the /auth-start flow", http.StatusServiceUnavailable)
+			return
+		}
+		h.ServeHTTP(rw, r)
+	})
 }
 
-func (e *Exporter) Describe(ch chan<- *prometheus.Desc) {
-	e.insideTemp.Describe(ch)
-	e.insideHumidity.Describe(ch)
-	e.outsideTemp.Describe(ch)
-	e.desiredHeat.Describe(ch)
-	e.desiredCool.Describe(ch)
-	e.cooling.Describe(ch)
-	e.heating.Describe(ch)
-	e.fanRunning.Describe(ch)
+// inFlightLimiter limits how many scrapes are served at once. Every scrape
+// may call the ecobee API, so many scrapers at once would otherwise
+// multiply the requests sent to ecobee.
+type inFlightLimiter struct {
+	// sem has a slot for each scrape that may be in flight. It is nil if
+	// there is no limit.
+	sem      chan struct{}
+	inFlight prometheus.Gauge
 }
 
-func (e *Exporter) Collect(ch chan<- prometheus.Metric) {
-	if err := e.refreshThermo(); err != nil {
-		log.Println("failed to refresh thermo", err)
-		return
+// newInFlightLimiter creates an inFlightLimiter allowing max scrapes at
+// once. max of 0 disables the limit.
+func newInFlightLimiter(max int) *inFlightLimiter {
+	l := &inFlightLimiter{
+		inFlight: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "ecobee_exporter_scrapes_in_flight",
+			Help: "Number of /metrics requests currently being served.",
+		}),
 	}
+	if max > 0 {
+		l.sem = make(chan struct{}, max)
+	}
+	return l
+}
+
+// wrap returns a handler that serves h unless the limit has been reached,
+// in which case it responds with 503.
+func (l *inFlightLimiter) wrap(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if l.sem != nil {
+			select {
+			case l.sem <- struct{}{}:
+				defer func() { <-l.sem }()
+			default:
+				http.Error(rw, "too many concurrent scrapes, try again later", http.StatusServiceUnavailable)
+				return
+			}
+		}
+
+		l.inFlight.Inc()
+		defer l.inFlight.Dec()
+		h.ServeHTTP(rw, r)
+	})
+}
+
+// refreshHandler returns the handler for /refresh, which scrapes exporters
+// with a forced full fetch of every thermostat. Responds with 502 if any
+// thermostat couldn't be retrieved from the ecobee API, which is reported
+// through ecobee_up. Responds with 500 only if the scraped metrics couldn't
+// be gathered or encoded, which isn't an ecobee failure.
+func refreshHandler(exporters *exporterSet) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		var buf bytes.Buffer
+		mfs, err := scrapeOnce(&buf, exporters.ForceRefresh(r.Context()))
+		if err != nil {
+			http.Error(rw, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		for _, mf := range mfs {
+			if mf.GetName() != "ecobee_up" {
+				continue
+			}
+			for _, m := range mf.GetMetric() {
+				if m.GetGauge().GetValue() != 1 {
+					http.Error(rw, fmt.Sprintf("failed to retrieve thermostat %s from the ecobee API", labelValue(m, "thermostat_id")), http.StatusBadGateway)
+					return
+				}
+			}
+		}
 
-	e.insideTemp.Set(float64(e.thermo.Runtime.ActualTemperature) / 10.0)
-	e.insideHumidity.Set(float64(e.thermo.Runtime.ActualHumidity))
-	e.desiredHeat.Set(float64(e.thermo.Runtime.DesiredHeat) / 10.0)
-	e.desiredCool.Set(float64(e.thermo.Runtime.DesiredCool) / 10.0)
+		rw.Header().Set("Content-Type", string(expfmt.FmtText))
+		_, _ = buf.WriteTo(rw)
+	})
+}
 
-	if len(e.thermo.Weather.Forecasts) > 0 {
-		temp := e.thermo.Weather.Forecasts[0].Temperature
-		e.outsideTemp.Set(float64(temp) / 10.0)
+// thermostatsHandler returns the handler for /thermostats, which responds
+// with the ID and name of every thermostat registered to the account.
+func thermostatsHandler(cli *ecobee.Client) http.Handler {
+	type entry struct {
+		ID   string `json:"id"`
+		Name string `json:"name"`
 	}
 
-	e.cooling.WithLabelValues("CompCool1").Set(boolToFloat64(e.summary.CompCool1))
-	e.cooling.WithLabelValues("CompCool2").Set(boolToFloat64(e.summary.CompCool2))
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		tss, err := getRegisteredThermostats(r.Context(), cli)
+		if err != nil {
+			http.Error(rw, err.Error(), http.StatusBadGateway)
+			return
+		}
+
+		entries := make([]entry, 0, len(tss))
+		for id, ts := range tss {
+			entries = append(entries, entry{ID: id, Name: ts.Name})
+		}
+		sort.Slice(entries, func(i, j int) bool { return entries[i].ID < entries[j].ID })
+
+		rw.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(rw).Encode(entries); err != nil {
+			http.Error(rw, err.Error(), http.StatusInternalServerError)
+		}
+	})
+}
 
-	e.heating.WithLabelValues("HeatPump").Set(boolToFloat64(e.summary.HeatPump))
-	e.heating.WithLabelValues("HeatPump2").Set(boolToFloat64(e.summary.HeatPump2))
-	e.heating.WithLabelValues("HeatPump3").Set(boolToFloat64(e.summary.HeatPump3))
-	e.heating.WithLabelValues("AuxHeat1").Set(boolToFloat64(e.summary.AuxHeat1))
-	e.heating.WithLabelValues("AuxHeat2").Set(boolToFloat64(e.summary.AuxHeat2))
-	e.heating.WithLabelValues("AuxHeat3").Set(boolToFloat64(e.summary.AuxHeat3))
+// scrapeContext returns a context for a scrape request that is cancelled
+// shortly before the scrape timeout Prometheus sends in the
+// X-Prometheus-Scrape-Timeout-Seconds header.
+func scrapeContext(r *http.Request) (context.Context, context.CancelFunc) {
+	timeout, err := strconv.ParseFloat(r.Header.Get("X-Prometheus-Scrape-Timeout-Seconds"), 64)
+	if err != nil || timeout <= 0 {
+		return context.WithCancel(r.Context())
+	}
 
-	e.fanRunning.Set(boolToFloat64(e.summary.Fan))
+	// Leave a little time to write the response before Prometheus gives up.
+	d := time.Duration(timeout * float64(time.Second))
+	d -= d / 10
+	return context.WithTimeout(r.Context(), d)
+}
 
-	e.insideTemp.Collect(ch)
-	e.insideHumidity.Collect(ch)
-	e.outsideTemp.Collect(ch)
-	e.desiredHeat.Collect(ch)
-	e.desiredCool.Collect(ch)
-	e.cooling.Collect(ch)
-	e.heating.Collect(ch)
-	e.fanRunning.Collect(ch)
+// normalizeRoutePrefix validates the value of -route-prefix. The prefix is
+// returned with a leading slash and without a trailing slash, or empty if
+// routes are served at the root.
+func normalizeRoutePrefix(prefix string) (string, error) {
+	prefix = strings.Trim(prefix, "/")
+	if prefix == "" {
+		return "", nil
+	}
+	if u, err := url.Parse(prefix); err != nil || u.Path != prefix {
+		return "", fmt.Errorf("invalid -route-prefix %q: must be a URL path", prefix)
+	}
+	return "/" + prefix, nil
 }
 
-func (e *Exporter) refreshThermo() error {
-	summary, err := getThermostatSummary(e.cli, e.thermostatID)
+// unixSocketPrefix marks a -listen-addr that is a path to a Unix domain
+// socket.
+const unixSocketPrefix = "unix://"
+
+// normalizeListenAddr validates the value of -listen-addr. A bare port like
+// "8080" is accepted and treated as ":8080". Addresses starting with
+// unix:// are paths to a Unix domain socket.
+func normalizeListenAddr(addr string) (string, error) {
+	if strings.HasPrefix(addr, unixSocketPrefix) {
+		if strings.TrimPrefix(addr, unixSocketPrefix) == "" {
+			return "", fmt.Errorf("invalid -listen-addr %q: missing socket path", addr)
+		}
+		return addr, nil
+	}
+	if _, err := strconv.ParseUint(addr, 10, 16); err == nil {
+		addr = ":" + addr
+	}
+	_, port, err := net.SplitHostPort(addr)
 	if err != nil {
-		return fmt.Errorf("failed refreshing thermo: %w", err)
+		return "", fmt.Errorf("invalid -listen-addr %q: must be of the form [host]:port: %w", addr, err)
+	}
+	if _, err := net.LookupPort("tcp", port); err != nil {
+		return "", fmt.Errorf("invalid -listen-addr %q: %w", addr, err)
+	}
+	return addr, nil
+}
+
+// listen creates a listener for an address returned by normalizeListenAddr.
+// A stale socket file left behind by a previous process is removed before
+// listening on a Unix domain socket.
+func listen(addr string) (net.Listener, error) {
+	if !strings.HasPrefix(addr, unixSocketPrefix) {
+		return net.Listen("tcp", addr)
 	}
-	e.summary = summary
 
-	if e.thermo == nil || summary.RuntimeRevision != e.thermo.Runtime.RuntimeRev {
-		log.Println("runtime revision changed, updating thermo object")
+	path := strings.TrimPrefix(addr, unixSocketPrefix)
+	if fi, err := os.Stat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		// Only remove the socket if nothing is listening on it anymore.
+		if conn, err := net.Dial("unix", path); err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("socket %s is already in use", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, fmt.Errorf("failed to remove stale socket: %w", err)
+		}
+	}
+	return net.Listen("unix", path)
+}
+
+// validateEndpointURL returns an error if the value of the flag name isn't an
+// absolute http or https URL.
+func validateEndpointURL(name, value string) error {
+	u, err := url.Parse(value)
+	if err != nil {
+		return fmt.Errorf("invalid %s: %w", name, err)
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("invalid %s: must be an absolute http or https URL", name)
+	}
+	return nil
+}
 
-		t, err := getThermostat(e.cli, e.thermostatID)
+// newTokenStore creates the TokenStore named by kind. uri is used by the
+// object storage backends and is of the form <scheme>://<bucket>/<object>.
+func newTokenStore(ctx context.Context, kind string, uri string) (ecobeeauth.TokenStore, error) {
+	switch kind {
+	case "memory":
+		return ecobeeauth.NewMemoryTokenStore(nil), nil
+	case "file":
+		if *flagCacheFile == "" {
+			return nil, nil
+		}
+		mode, err := strconv.ParseUint(*flagCacheDirMode, 8, 32)
 		if err != nil {
-			return fmt.Errorf("failed getting updated thermostat: %w", err)
+			return nil, fmt.Errorf("invalid -cache-dir-mode %q: must be an octal file mode", *flagCacheDirMode)
 		}
+		fs := ecobeeauth.NewFileStore(*flagCacheFile)
+		fs.DirMode = os.FileMode(mode)
+		return fs, nil
+	case "s3", "gcs":
+		// Both stores are configured by -token-store-uri below.
+	default:
+		return nil, fmt.Errorf("unknown -token-store %q", kind)
+	}
 
-		e.thermo = t
+	u, err := url.Parse(uri)
+	if err != nil {
+		return nil, fmt.Errorf("invalid -token-store-uri: %w", err)
+	}
+	bucket, object := u.Host, strings.TrimPrefix(u.Path, "/")
+	if bucket == "" || object == "" {
+		return nil, fmt.Errorf("-token-store-uri must be of the form <scheme>://<bucket>/<object>")
 	}
 
-	return nil
+	if kind == "s3" {
+		if u.Scheme != "s3" {
+			return nil, fmt.Errorf("-token-store-uri must use the s3:// scheme")
+		}
+		return ecobeeauth.NewS3Store(bucket, object)
+	}
+	if u.Scheme != "gs" {
+		return nil, fmt.Errorf("-token-store-uri must use the gs:// scheme")
+	}
+	return ecobeeauth.NewGCSStore(ctx, bucket, object)
 }
 
-func boolToFloat64(v bool) float64 {
-	if v {
-		return 1.0
+// requiredScopes returns the ecobee scopes the token needs for the exporter
+// to work. Writing requires smartWrite, which also grants read access.
+func requiredScopes(write bool) []string {
+	if write {
+		return []string{"smartWrite"}
 	}
-	return 0.0
+	return []string{"smartRead"}
 }
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/rfratto/ecobee_exporter/ecobeeauth"
+	"github.com/rspier/go-ecobee/ecobee"
+	"golang.org/x/oauth2"
+)
+
+func TestCancelOnSignal(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		cancelOnSignal(ctx, cancel, syscall.SIGUSR1)
+	}()
+
+	// Give cancelOnSignal time to start listening for the signal, otherwise
+	// SIGUSR1 would terminate the test binary.
+	time.Sleep(100 * time.Millisecond)
+	if err := syscall.Kill(os.Getpid(), syscall.SIGUSR1); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-ctx.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("context not canceled after signal")
+	}
+	<-done
+}
+
+// TestShutdown_BackgroundLoops checks that every background goroutine
+// started by main returns once the context is canceled.
+func TestShutdown_BackgroundLoops(t *testing.T) {
+	// Accept pushes from the pusher and the OTLP exporter.
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		rw.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+
+	ts, err := ecobeeauth.NewTokenSource(context.Background(), "client-id", ecobeeauth.NewMemoryTokenStore(&oauth2.Token{
+		AccessToken:  "access",
+		RefreshToken: "refresh",
+		Expiry:       time.Now().Add(time.Hour),
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	collectors, err := parseCollectors(defaultCollectors)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cli := &ecobee.Client{Client: &http.Client{Transport: selfTestTransport{}}}
+	exporters := newExporterSet(cli, ExporterConfig{
+		Collectors:      collectors,
+		TemperatureUnit: unitFahrenheit,
+	}, []string{selfTestThermostatID})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var wg sync.WaitGroup
+	start := func(name string, f func()) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			f()
+			t.Logf("%s returned", name)
+		}()
+	}
+	start("token refresher", func() { ts.RunRefresher(ctx, time.Minute, time.Second) })
+	start("thermostat refresher", func() { exporters.RunRefresher(ctx, time.Hour) })
+	start("pusher", func() {
+		runPusher(ctx, srv.URL, "ecobee_exporter", "test", time.Hour, false, ts, exporters)
+	})
+	start("otlp exporter", func() { runOTLPExporter(ctx, srv.URL, nil, time.Hour, ts, exporters) })
+
+	// Let every loop get past its first iteration before shutting down.
+	time.Sleep(100 * time.Millisecond)
+	cancel()
+
+	waitCtx, waitCancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer waitCancel()
+	if !waitGroupDone(waitCtx, &wg) {
+		t.Fatal("background goroutines did not return after the context was canceled")
+	}
+}
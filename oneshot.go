@@ -0,0 +1,42 @@
+package main
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	"github.com/rfratto/ecobee_exporter/ecobeeauth"
+)
+
+// oneshot performs a single scrape of the thermostat and token metrics and
+// writes them to w in the Prometheus text format.
+func oneshot(w io.Writer, ts *ecobeeauth.TokenSource, exporters *exporterSet) error {
+	_, err := scrapeOnce(w, exporters, newTokenCollector(ts))
+	return err
+}
+
+// scrapeOnce collects cs into a fresh registry and writes the result to w in
+// the Prometheus text format. The gathered metrics are returned so callers
+// can inspect them.
+func scrapeOnce(w io.Writer, cs ...prometheus.Collector) ([]*dto.MetricFamily, error) {
+	reg := prometheus.NewRegistry()
+	for _, c := range cs {
+		if err := reg.Register(c); err != nil {
+			return nil, fmt.Errorf("failed to register collector: %w", err)
+		}
+	}
+	mfs, err := reg.Gather()
+	if err != nil {
+		return nil, fmt.Errorf("failed to gather metrics: %w", err)
+	}
+
+	enc := expfmt.NewEncoder(w, expfmt.FmtText)
+	for _, mf := range mfs {
+		if err := enc.Encode(mf); err != nil {
+			return nil, fmt.Errorf("failed to write metrics: %w", err)
+		}
+	}
+	return mfs, nil
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/rfratto/ecobee_exporter/ecobeeauth"
+)
+
+// Values of -metrics-exporter.
+const (
+	metricsExporterPrometheus = "prometheus"
+	metricsExporterOTLP       = "otlp"
+)
+
+// runOTLPExporter collects the exporter and token metrics every interval and
+// sends them with header to the OTLP/HTTP endpoint at url until ctx is
+// canceled.
+//
+// Metrics are gathered the same way as for /metrics and converted to the
+// JSON encoding of OTLP, which every OTLP/HTTP receiver accepts. This avoids
+// pulling in the OpenTelemetry SDK just to translate a handful of gauges.
+func runOTLPExporter(ctx context.Context, url string, header http.Header, interval time.Duration, ts *ecobeeauth.TokenSource, exporters *exporterSet) {
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(exporters.WithContext(ctx), newTokenCollector(ts))
+
+	start := time.Now()
+
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	for {
+		if err := pushOTLP(ctx, url, header, reg, start); err != nil {
+			log.Println("failed to export metrics over otlp:", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
+
+func pushOTLP(ctx context.Context, url string, header http.Header, g prometheus.Gatherer, start time.Time) error {
+	mfs, err := g.Gather()
+	if err != nil {
+		return fmt.Errorf("failed to gather metrics: %w", err)
+	}
+	bb, err := json.Marshal(otlpRequest(mfs, start, time.Now()))
+	if err != nil {
+		return fmt.Errorf("failed to encode metrics: %w", err)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(bb))
+	if err != nil {
+		return fmt.Errorf("could not create request: %w", err)
+	}
+	for k, vv := range header {
+		req.Header[k] = vv
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("error sending metrics: %w", err)
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(ioutil.Discard, resp.Body)
+
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("invalid server response: %s", resp.Status)
+	}
+	return nil
+}
+
+// parseOTLPHeaders parses the comma-separated key=value headers of
+// -otlp-header, the same format as OTEL_EXPORTER_OTLP_HEADERS. Values are
+// URL-decoded, so %2C can be used for a comma.
+func parseOTLPHeaders(s string) (http.Header, error) {
+	header := make(http.Header)
+	for _, kv := range strings.Split(s, ",") {
+		if strings.TrimSpace(kv) == "" {
+			continue
+		}
+		i := strings.Index(kv, "=")
+		if i < 0 {
+			return nil, fmt.Errorf("invalid -otlp-header %q, must be key=value", kv)
+		}
+		key := strings.TrimSpace(kv[:i])
+		value, err := url.PathUnescape(strings.TrimSpace(kv[i+1:]))
+		if key == "" || err != nil {
+			return nil, fmt.Errorf("invalid -otlp-header %q, must be key=value", kv)
+		}
+		header.Add(key, value)
+	}
+	return header, nil
+}
+
+// The types below are the subset of the OTLP metrics data model used by the
+// exporter:
+// https://github.com/open-telemetry/opentelemetry-proto/blob/main/opentelemetry/proto/metrics/v1/metrics.proto
+type (
+	otlpExportRequest struct {
+		ResourceMetrics []otlpResourceMetrics `json:"resourceMetrics"`
+	}
+	otlpResourceMetrics struct {
+		Resource     otlpResource       `json:"resource"`
+		ScopeMetrics []otlpScopeMetrics `json:"scopeMetrics"`
+	}
+	otlpResource struct {
+		Attributes []otlpKeyValue `json:"attributes"`
+	}
+	otlpScopeMetrics struct {
+		Scope   otlpScope    `json:"scope"`
+		Metrics []otlpMetric `json:"metrics"`
+	}
+	otlpScope struct {
+		Name string `json:"name"`
+	}
+	otlpMetric struct {
+		Name        string     `json:"name"`
+		Description string     `json:"description,omitempty"`
+		Gauge       *otlpGauge `json:"gauge,omitempty"`
+		Sum         *otlpSum   `json:"sum,omitempty"`
+	}
+	otlpGauge struct {
+		DataPoints []otlpDataPoint `json:"dataPoints"`
+	}
+	otlpSum struct {
+		DataPoints             []otlpDataPoint `json:"dataPoints"`
+		AggregationTemporality int             `json:"aggregationTemporality"`
+		IsMonotonic            bool            `json:"isMonotonic"`
+	}
+	otlpDataPoint struct {
+		Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+		StartTimeUnixNano string         `json:"startTimeUnixNano,omitempty"`
+		TimeUnixNano      string         `json:"timeUnixNano"`
+		AsDouble          float64        `json:"asDouble"`
+	}
+	otlpKeyValue struct {
+		Key   string       `json:"key"`
+		Value otlpAnyValue `json:"value"`
+	}
+	otlpAnyValue struct {
+		StringValue string `json:"stringValue"`
+	}
+)
+
+// otlpCumulative is AGGREGATION_TEMPORALITY_CUMULATIVE.
+const otlpCumulative = 2
+
+// otlpRequest converts gathered Prometheus metrics into an OTLP export
+// request. Gauges and untyped metrics become OTLP gauges and counters become
+// cumulative monotonic sums starting at start. Other metric types aren't
+// produced by the exporter and are dropped.
+func otlpRequest(mfs []*dto.MetricFamily, start, now time.Time) otlpExportRequest {
+	var (
+		startNano = strconv.FormatInt(start.UnixNano(), 10)
+		nowNano   = strconv.FormatInt(now.UnixNano(), 10)
+		metrics   []otlpMetric
+	)
+
+	for _, mf := range mfs {
+		m := otlpMetric{Name: mf.GetName(), Description: mf.GetHelp()}
+
+		var points []otlpDataPoint
+		for _, pm := range mf.GetMetric() {
+			var attrs []otlpKeyValue
+			for _, lp := range pm.GetLabel() {
+				attrs = append(attrs, otlpKeyValue{Key: lp.GetName(), Value: otlpAnyValue{StringValue: lp.GetValue()}})
+			}
+
+			p := otlpDataPoint{Attributes: attrs, TimeUnixNano: nowNano}
+			switch mf.GetType() {
+			case dto.MetricType_GAUGE:
+				p.AsDouble = pm.GetGauge().GetValue()
+			case dto.MetricType_UNTYPED:
+				p.AsDouble = pm.GetUntyped().GetValue()
+			case dto.MetricType_COUNTER:
+				p.AsDouble = pm.GetCounter().GetValue()
+				p.StartTimeUnixNano = startNano
+			}
+			points = append(points, p)
+		}
+
+		switch mf.GetType() {
+		case dto.MetricType_GAUGE, dto.MetricType_UNTYPED:
+			m.Gauge = &otlpGauge{DataPoints: points}
+		case dto.MetricType_COUNTER:
+			m.Sum = &otlpSum{DataPoints: points, AggregationTemporality: otlpCumulative, IsMonotonic: true}
+		default:
+			continue
+		}
+		metrics = append(metrics, m)
+	}
+
+	return otlpExportRequest{
+		ResourceMetrics: []otlpResourceMetrics{{
+			Resource: otlpResource{
+				Attributes: []otlpKeyValue{{Key: "service.name", Value: otlpAnyValue{StringValue: "ecobee_exporter"}}},
+			},
+			ScopeMetrics: []otlpScopeMetrics{{
+				Scope:   otlpScope{Name: "github.com/rfratto/ecobee_exporter"},
+				Metrics: metrics,
+			}},
+		}},
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestParseOTLPHeaders(t *testing.T) {
+	tt := []struct {
+		in      string
+		want    http.Header
+		wantErr bool
+	}{
+		{in: "", want: http.Header{}},
+		{
+			in: "Authorization=Bearer token, x-scope-orgid=home",
+			want: http.Header{
+				"Authorization": []string{"Bearer token"},
+				"X-Scope-Orgid": []string{"home"},
+			},
+		},
+		{in: "X-Tags=a%2Cb", want: http.Header{"X-Tags": []string{"a,b"}}},
+		{in: "Authorization", wantErr: true},
+		{in: "=value", wantErr: true},
+	}
+
+	for _, tc := range tt {
+		got, err := parseOTLPHeaders(tc.in)
+		if tc.wantErr {
+			if err == nil {
+				t.Errorf("parseOTLPHeaders(%q) succeeded, want error", tc.in)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseOTLPHeaders(%q): %v", tc.in, err)
+		} else if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("parseOTLPHeaders(%q) = %v, want %v", tc.in, got, tc.want)
+		}
+	}
+}
+
+func TestPushOTLP_Headers(t *testing.T) {
+	var got http.Header
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		got = r.Header.Clone()
+		rw.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+
+	header := http.Header{"Authorization": []string{"Bearer token"}}
+	if err := pushOTLP(context.Background(), srv.URL, header, prometheus.NewRegistry(), time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if v := got.Get("Authorization"); v != "Bearer token" {
+		t.Errorf("Authorization header = %q, want %q", v, "Bearer token")
+	}
+	if v := got.Get("Content-Type"); v != "application/json" {
+		t.Errorf("Content-Type header = %q, want application/json", v)
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/push"
+	"github.com/rfratto/ecobee_exporter/ecobeeauth"
+)
+
+// runPusher collects the exporter and token metrics every interval and
+// pushes them to the Pushgateway at url until ctx is canceled. Each push
+// replaces the metrics previously pushed for the same job and instance.
+//
+// If align is true, pushes after the first happen at wall clock multiples
+// of interval (e.g., on the hour and every 3 minutes after) rather than
+// relative to when the exporter started.
+func runPusher(ctx context.Context, url, job, instance string, interval time.Duration, align bool, ts *ecobeeauth.TokenSource, exporters *exporterSet) {
+	// Collecting and pushing are both bound to ctx so that a hung ecobee API
+	// or Pushgateway doesn't hold up shutdown. This version of the push
+	// package has no PushContext, so the context is set by the HTTP client.
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(exporters.WithContext(ctx), newTokenCollector(ts))
+
+	pusher := push.New(url, job).Gatherer(reg).Client(&http.Client{
+		Transport: &contextTransport{ctx: ctx, base: http.DefaultTransport},
+	})
+	if instance != "" {
+		pusher = pusher.Grouping("instance", instance)
+	}
+
+	push := func() {
+		if err := pusher.Push(); err != nil {
+			log.Println("failed to push metrics to pushgateway:", err)
+		}
+	}
+
+	push()
+	if align {
+		// Start the ticker on a multiple of interval so it keeps firing on
+		// multiples of interval.
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(time.Until(time.Now().Truncate(interval).Add(interval))):
+		}
+		push()
+	}
+
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+		push()
+	}
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"strings"
+	"time"
+
+	"github.com/rspier/go-ecobee/ecobee"
+)
+
+// The ecobee program schedule is a grid of 7 days, starting on Monday, with
+// 48 half-hour slots per day. Each slot holds the climate ref that is
+// scheduled for that half hour.
+const (
+	scheduleDays        = 7
+	scheduleSlotsPerDay = 48
+	scheduleSlotLength  = 30 * time.Minute
+)
+
+// scheduleSlot returns the position in the schedule grid for the wall clock
+// time t.
+func scheduleSlot(t time.Time) (day, slot int) {
+	// time.Weekday starts on Sunday; the schedule starts on Monday.
+	day = (int(t.Weekday()) + 6) % scheduleDays
+	slot = (t.Hour()*60 + t.Minute()) / int(scheduleSlotLength/time.Minute)
+	return day, slot
+}
+
+// validSchedule returns true if schedule is a complete schedule grid.
+func validSchedule(schedule [][]string) bool {
+	if len(schedule) != scheduleDays {
+		return false
+	}
+	for _, day := range schedule {
+		if len(day) != scheduleSlotsPerDay {
+			return false
+		}
+	}
+	return true
+}
+
+// scheduledClimate returns the climate ref the schedule holds for the wall
+// clock time now. ok is false if the schedule is invalid.
+func scheduledClimate(schedule [][]string, now time.Time) (ref string, ok bool) {
+	if !validSchedule(schedule) {
+		return "", false
+	}
+	day, slot := scheduleSlot(now)
+	return schedule[day][slot], true
+}
+
+// nextClimateChange finds the next slot after now in schedule whose climate
+// differs from the climate scheduled at now. It returns the climate ref of
+// that slot and how long until it starts. ok is false if the schedule is
+// invalid or never changes.
+func nextClimateChange(schedule [][]string, now time.Time) (ref string, in time.Duration, ok bool) {
+	if !validSchedule(schedule) {
+		return "", 0, false
+	}
+
+	day, slot := scheduleSlot(now)
+	current := schedule[day][slot]
+
+	// Start of the current slot, used to compute the start of later slots.
+	slotStart := time.Date(now.Year(), now.Month(), now.Day(), now.Hour(), now.Minute(), 0, 0, now.Location())
+	slotStart = slotStart.Add(-time.Duration(now.Minute()%int(scheduleSlotLength/time.Minute)) * time.Minute)
+
+	for i := 1; i <= scheduleDays*scheduleSlotsPerDay; i++ {
+		idx := day*scheduleSlotsPerDay + slot + i
+		d, s := (idx/scheduleSlotsPerDay)%scheduleDays, idx%scheduleSlotsPerDay
+		if schedule[d][s] != current {
+			start := slotStart.Add(time.Duration(i) * scheduleSlotLength)
+			return schedule[d][s], start.Sub(now), true
+		}
+	}
+	return "", 0, false
+}
+
+// overridingEvents are the event types that take precedence over the
+// program schedule while they are running. Other event types, like
+// demandResponse or sensor, adjust the scheduled climate rather than
+// replace it.
+var overridingEvents = map[string]bool{
+	"hold":      true,
+	"vacation":  true,
+	"quickSave": true,
+	"autoAway":  true,
+	"autoHome":  true,
+	"today":     true,
+}
+
+// followingSchedule returns true if none of events is currently overriding
+// the program schedule.
+func followingSchedule(events []ecobee.Event) bool {
+	for _, ev := range events {
+		if ev.Running && overridingEvents[ev.Type] {
+			return false
+		}
+	}
+	return true
+}
+
+// autoAwayActive returns true if Smart Home/Away is overriding the program
+// schedule. ecobee reports this as a running autoAway event when it detects
+// that nobody is home during an occupied climate, or autoHome when it
+// detects someone home during an unoccupied climate.
+func autoAwayActive(events []ecobee.Event) bool {
+	for _, ev := range events {
+		if ev.Running && (ev.Type == "autoAway" || ev.Type == "autoHome") {
+			return true
+		}
+	}
+	return false
+}
+
+// smartRecoveryActive returns true if Smart Recovery is preheating or
+// precooling the thermostat ahead of the next climate. ecobee doesn't report
+// Smart Recovery directly; while it runs, the runtime's desiredHeat or
+// desiredCool ramp away from the heatTemp and coolTemp of the running
+// climate without any event being responsible. If s isn't nil, its
+// disablePreHeating and disablePreCooling flags rule out recovery in the
+// disabled direction.
+func smartRecoveryActive(t *thermostat, s *settings) bool {
+	for _, ev := range t.Events {
+		if ev.Running {
+			return false
+		}
+	}
+
+	var climate *ecobee.Climate
+	for i, c := range t.Program.Climates {
+		if c.ClimateRef == t.Program.CurrentClimateRef {
+			climate = &t.Program.Climates[i]
+			break
+		}
+	}
+	if climate == nil {
+		return false
+	}
+
+	// Preheating raises the desired heat above the climate's; precooling
+	// lowers the desired cool below it.
+	preheating := t.Runtime.DesiredHeat > climate.HeatTemp
+	precooling := t.Runtime.DesiredCool < climate.CoolTemp
+	if s != nil {
+		preheating = preheating && !s.DisablePreHeating
+		precooling = precooling && !s.DisablePreCooling
+	}
+	return preheating || precooling
+}
+
+// demandResponseEvent returns the running demand response event, which a
+// utility sends to adjust the thermostat during peak demand. ok is false if
+// none is running.
+func demandResponseEvent(events []ecobee.Event) (ev ecobee.Event, ok bool) {
+	for _, ev := range events {
+		if ev.Running && ev.Type == "demandResponse" {
+			return ev, true
+		}
+	}
+	return ecobee.Event{}, false
+}
+
+// holdTempEvent returns the first running event that sets absolute heat and
+// cool hold temperatures. ok is false if no such event is running.
+func holdTempEvent(events []ecobee.Event) (ev ecobee.Event, ok bool) {
+	for _, ev := range events {
+		if ev.Running && ev.IsTemperatureAbsolute {
+			return ev, true
+		}
+	}
+	return ecobee.Event{}, false
+}
+
+// climateSensorID converts the ID of a sensor in a climate, which also
+// identifies the sensor's capability (e.g., "rs:100:1"), to the ID of the
+// sensor itself ("rs:100").
+func climateSensorID(id string) string {
+	if parts := strings.Split(id, ":"); len(parts) == 3 {
+		return parts[0] + ":" + parts[1]
+	}
+	return id
+}
+
+// indefiniteHold is how far away the end of a hold has to be for it to be
+// considered indefinite. ecobee doesn't leave the end of indefinite holds
+// empty; it sets it years in the future instead.
+const indefiniteHold = 365 * 24 * time.Hour
+
+// holdEnd returns the end of the running hold in events, as wall clock time
+// of the thermostat. ok is false if no hold is running or the hold is
+// indefinite.
+func holdEnd(events []ecobee.Event, now time.Time) (end time.Time, ok bool) {
+	for _, ev := range events {
+		if !ev.Running || ev.Type != "hold" || ev.EndDate == "" || ev.EndTime == "" {
+			continue
+		}
+		end, err := parseEcobeeTime(ev.EndDate+" "+ev.EndTime, time.UTC)
+		if err != nil || end.Sub(now) >= indefiniteHold {
+			return time.Time{}, false
+		}
+		return end, true
+	}
+	return time.Time{}, false
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/rspier/go-ecobee/ecobee"
+)
+
+// selfTestThermostatID is the ID of the fixture thermostat used by selfTest.
+const selfTestThermostatID = "123456789012"
+
+// selfTestSummary is the fixture thermostat summary response. The cool stage
+// and fan are running.
+const selfTestSummary = `{
+	"thermostatCount": 1,
+	"revisionList": ["123456789012:Fixture:true:1:1:1:1"],
+	"statusList": ["123456789012:compCool1,fan"],
+	"status": {"code": 0, "message": ""}
+}`
+
+// selfTestThermostat is the fixture thermostat response. ecobee reports
+// temperatures in tenths of a degree Fahrenheit, so 712 is 71.2°F.
+const selfTestThermostat = `{
+	"thermostatList": [{
+		"identifier": "123456789012",
+		"name": "Fixture",
+		"runtime": {
+			"runtimeRev": "1",
+			"actualTemperature": 712,
+			"actualHumidity": 41,
+			"desiredHeat": 680,
+			"desiredCool": 750
+		},
+		"weather": {
+			"forecasts": [{"temperature": 455}]
+		},
+		"remoteSensors": [{
+			"id": "rs:100",
+			"name": "Bedroom",
+			"type": "ecobee3_remote_sensor",
+			"capability": [
+				{"id": "1", "type": "temperature", "value": "698"},
+				{"id": "2", "type": "occupancy", "value": "true"}
+			]
+		}],
+		"settings": {
+			"tempCorrection": -20,
+			"heatRangeLow": 450,
+			"coolRangeHigh": 920
+		}
+	}],
+	"status": {"code": 0, "message": ""}
+}`
+
+// selfTestCheck is a metric value expected from scraping the fixture.
+type selfTestCheck struct {
+	name   string
+	labels map[string]string
+	want   float64
+}
+
+// selfTestCase scrapes the fixture with a temperature format and checks the
+// resulting metrics.
+type selfTestCase struct {
+	format temperatureFormat
+	checks []selfTestCheck
+}
+
+// selfTestCases documents how raw ecobee values are scaled into metrics.
+var selfTestCases = []selfTestCase{
+	{
+		format: temperatureFormat{unit: unitFahrenheit, precision: -1},
+		checks: []selfTestCheck{
+			{name: "ecobee_up", want: 1},
+			{name: "ecobee_consecutive_scrape_failures", want: 0},
+			{name: "ecobee_inside_temperature", want: 71.2},
+			{name: "ecobee_inside_humidity", want: 41},
+			{name: "ecobee_desired_heat", want: 68},
+			{name: "ecobee_desired_cool", want: 75},
+			{name: "ecobee_outside_temperature", want: 45.5},
+			{name: "ecobee_sensor_temperature", labels: map[string]string{"sensor_id": "rs:100"}, want: 69.8},
+			{name: "ecobee_sensor_occupied", labels: map[string]string{"sensor_id": "rs:100"}, want: 1},
+			{name: "ecobee_temperature_correction", want: -2},
+			{name: "ecobee_heat_range_low", want: 45},
+			{name: "ecobee_cool_range_high", want: 92},
+			{name: "ecobee_cooling_stage", labels: map[string]string{"stage": "CompCool1"}, want: 1},
+			{name: "ecobee_cooling_stage", labels: map[string]string{"stage": "CompCool2"}, want: 0},
+			{name: "ecobee_cooling_active_stages", want: 1},
+			{name: "ecobee_heating_active_stages", want: 0},
+			{name: "ecobee_fan_running", want: 1},
+			{name: "ecobee_equipment_status_raw", labels: map[string]string{"status": "compCool1,fan"}, want: 1},
+			{name: "ecobee_system_state", labels: map[string]string{"state": stateCooling}, want: 1},
+		},
+	},
+	{
+		// Temperature differences like the correction are converted without
+		// the 32°F offset.
+		format: temperatureFormat{unit: unitCelsius, precision: 2},
+		checks: []selfTestCheck{
+			{name: "ecobee_inside_temperature", want: 21.78},
+			{name: "ecobee_desired_heat", want: 20},
+			{name: "ecobee_outside_temperature", want: 7.5},
+			{name: "ecobee_temperature_correction", want: -1.11},
+		},
+	},
+	{
+		format: temperatureFormat{unit: unitBoth, precision: 1},
+		checks: []selfTestCheck{
+			{name: "ecobee_inside_temperature", labels: map[string]string{"unit": string(unitFahrenheit)}, want: 71.2},
+			{name: "ecobee_inside_temperature", labels: map[string]string{"unit": string(unitCelsius)}, want: 21.8},
+		},
+	},
+}
+
+// selfTest scrapes a built-in fixture thermostat without calling the ecobee
+// API and checks that raw values are scaled into the expected metrics. The
+// result of each check is written to w. An error is returned if any check
+// fails.
+func selfTest(w io.Writer) error {
+	var failed int
+	for _, tc := range selfTestCases {
+		collectors, err := parseCollectors(defaultCollectors + "," + collectorSettings)
+		if err != nil {
+			return err
+		}
+		cli := &ecobee.Client{Client: &http.Client{Transport: selfTestTransport{}}}
+		exporter := NewExporter(cli, ExporterConfig{
+			ThermostatID:         selfTestThermostatID,
+			Collectors:           collectors,
+			TemperatureUnit:      tc.format.unit,
+			TemperaturePrecision: tc.format.precision,
+		})
+
+		mfs, err := scrapeOnce(ioutil.Discard, exporter)
+		if err != nil {
+			return err
+		}
+		for _, c := range tc.checks {
+			got, ok := findMetric(mfs, c.name, c.labels)
+			switch {
+			case !ok:
+				failed++
+				fmt.Fprintf(w, "FAIL %s %s: metric not found\n", tc.format.unit, c)
+			case math.Abs(got-c.want) > 1e-9:
+				failed++
+				fmt.Fprintf(w, "FAIL %s %s: got %v, want %v\n", tc.format.unit, c, got, c.want)
+			default:
+				fmt.Fprintf(w, "PASS %s %s = %v\n", tc.format.unit, c, got)
+			}
+		}
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d checks failed", failed)
+	}
+	return nil
+}
+
+func (c selfTestCheck) String() string {
+	if len(c.labels) == 0 {
+		return c.name
+	}
+	pairs := make([]string, 0, len(c.labels))
+	for k, v := range c.labels {
+		pairs = append(pairs, fmt.Sprintf("%s=%q", k, v))
+	}
+	sort.Strings(pairs)
+	return c.name + "{" + strings.Join(pairs, ",") + "}"
+}
+
+// findMetric returns the value of the first gauge or counter in mfs named
+// name that has all of labels.
+func findMetric(mfs []*dto.MetricFamily, name string, labels map[string]string) (float64, bool) {
+	for _, mf := range mfs {
+		if mf.GetName() != name {
+			continue
+		}
+	metrics:
+		for _, m := range mf.GetMetric() {
+			for k, v := range labels {
+				if !hasLabel(m, k, v) {
+					continue metrics
+				}
+			}
+			switch mf.GetType() {
+			case dto.MetricType_COUNTER:
+				return m.GetCounter().GetValue(), true
+			default:
+				return m.GetGauge().GetValue(), true
+			}
+		}
+	}
+	return 0, false
+}
+
+func hasLabel(m *dto.Metric, name, value string) bool {
+	for _, lp := range m.GetLabel() {
+		if lp.GetName() == name {
+			return lp.GetValue() == value
+		}
+	}
+	return false
+}
+
+// selfTestTransport serves the fixture responses in place of the ecobee API.
+type selfTestTransport struct{}
+
+func (selfTestTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	var body string
+	switch req.URL.Path {
+	case "/1/thermostatSummary":
+		body = selfTestSummary
+	case "/1/thermostat":
+		body = selfTestThermostat
+	default:
+		return nil, fmt.Errorf("self-test: unexpected request to %s", req.URL)
+	}
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Status:     "200 OK",
+		Header:     http.Header{"Content-Type": []string{"application/json"}},
+		Body:       ioutil.NopCloser(strings.NewReader(body)),
+		Request:    req,
+	}, nil
+}
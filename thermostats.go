@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strings"
+)
+
+// readThermostatIDs reads thermostat IDs from the file at path. IDs are
+// separated by commas or newlines. Blank lines are skipped and anything after
+// a # is treated as a comment. IDs listed more than once are only returned
+// once.
+func readThermostatIDs(path string) ([]string, error) {
+	bb, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read thermostat IDs: %w", err)
+	}
+
+	var ids []string
+	for n, line := range strings.Split(string(bb), "\n") {
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		lineIDs, err := parseThermostatIDs(line)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, n+1, err)
+		}
+		ids = append(ids, lineIDs...)
+	}
+	if len(ids) == 0 {
+		return nil, fmt.Errorf("%s: no thermostat IDs found", path)
+	}
+	return dedupeThermostatIDs(ids), nil
+}
+
+// parseThermostatIDs parses a comma-separated list of thermostat IDs.
+// Whitespace around IDs and empty IDs are ignored, and IDs listed more than
+// once are only returned once.
+func parseThermostatIDs(s string) ([]string, error) {
+	var ids []string
+	for _, id := range strings.Split(s, ",") {
+		id = strings.TrimSpace(id)
+		if id == "" {
+			continue
+		}
+		if err := validateThermostatID(id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return dedupeThermostatIDs(ids), nil
+}
+
+// dedupeThermostatIDs returns ids without repeated IDs, keeping the order
+// in which they're first listed. Each thermostat must only be scraped once,
+// since its metrics would otherwise be duplicated.
+func dedupeThermostatIDs(ids []string) []string {
+	seen := make(map[string]bool, len(ids))
+	deduped := ids[:0:0]
+	for _, id := range ids {
+		if seen[id] {
+			continue
+		}
+		seen[id] = true
+		deduped = append(deduped, id)
+	}
+	return deduped
+}
+
+// validateThermostatID returns an error if id isn't a valid ecobee
+// thermostat identifier. Thermostat identifiers are the numeric serial
+// numbers of the thermostats.
+func validateThermostatID(id string) error {
+	for _, r := range id {
+		if r < '0' || r > '9' {
+			return fmt.Errorf("invalid thermostat ID %q: must only contain digits", id)
+		}
+	}
+	return nil
+}
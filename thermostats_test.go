@@ -0,0 +1,48 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestParseThermostatIDs(t *testing.T) {
+	tt := []struct {
+		in   string
+		want []string
+	}{
+		{"1", []string{"1"}},
+		{" 1, 2 ,,3 ", []string{"1", "2", "3"}},
+		{"1,1", []string{"1"}},
+		{"2,1,2,3,1", []string{"2", "1", "3"}},
+	}
+	for _, tc := range tt {
+		got, err := parseThermostatIDs(tc.in)
+		if err != nil {
+			t.Errorf("parseThermostatIDs(%q): %v", tc.in, err)
+		} else if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("parseThermostatIDs(%q) = %q, want %q", tc.in, got, tc.want)
+		}
+	}
+
+	if _, err := parseThermostatIDs("1,abc"); err == nil {
+		t.Error("parseThermostatIDs accepted a non-numeric ID")
+	}
+}
+
+func TestReadThermostatIDs_Duplicates(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ids")
+	contents := "111 # living room\n222,111\n\n222\n333\n"
+	if err := ioutil.WriteFile(path, []byte(contents), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := readThermostatIDs(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"111", "222", "333"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("readThermostatIDs = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rfratto/ecobee_exporter/ecobeeauth"
+)
+
+// tokenCollector exposes metrics about the lifecycle of the ecobee oauth
+// token. It is kept separate from Exporter so token metrics are still
+// reported when scraping the thermostat fails.
+type tokenCollector struct {
+	ts *ecobeeauth.TokenSource
+
+	// warnAge is the age of the authorization after which
+	// ecobee_refresh_token_expiry_warning is set.
+	warnAge time.Duration
+
+	valid           *prometheus.Desc
+	expiry          *prometheus.Desc
+	refreshFailures *prometheus.Desc
+	refreshSkipped  *prometheus.Desc
+	reAuthRequired  *prometheus.Desc
+	loadErrors      *prometheus.Desc
+	lastError       *prometheus.Desc
+	refreshTokenAge *prometheus.Desc
+	expiryWarning   *prometheus.Desc
+	scopesInfo      *prometheus.Desc
+}
+
+func newTokenCollector(ts *ecobeeauth.TokenSource) *tokenCollector {
+	return &tokenCollector{
+		ts:      ts,
+		warnAge: *flagRefreshWarn,
+
+		valid: prometheus.NewDesc(
+			"ecobee_token_valid",
+			"1 if a token is available and has not expired.",
+			nil, nil,
+		),
+		expiry: prometheus.NewDesc(
+			"ecobee_token_expiry_seconds",
+			"Seconds until the current access token expires. Negative once expired.",
+			nil, nil,
+		),
+		refreshFailures: prometheus.NewDesc(
+			"ecobee_token_refresh_failures_total",
+			"Total number of failed attempts to refresh the token.",
+			nil, nil,
+		),
+		refreshSkipped: prometheus.NewDesc(
+			"ecobee_token_refresh_skipped_total",
+			"Total number of refreshes skipped because another process sharing the token store already refreshed the token.",
+			nil, nil,
+		),
+		reAuthRequired: prometheus.NewDesc(
+			"ecobee_reauth_required",
+			"1 if ecobee rejected the refresh token and the pin flow must be run again.",
+			nil, nil,
+		),
+		loadErrors: prometheus.NewDesc(
+			"ecobee_token_cache_load_errors_total",
+			"Total number of times the token couldn't be loaded from the token store.",
+			nil, nil,
+		),
+		lastError: prometheus.NewDesc(
+			"ecobee_last_auth_error",
+			"1 with the reason of the last authentication failure (e.g., network, invalid_grant, pin_expired). Absent once authentication succeeds.",
+			[]string{"reason"}, nil,
+		),
+		refreshTokenAge: prometheus.NewDesc(
+			"ecobee_refresh_token_age_seconds",
+			"Seconds since the pin flow authorizing the token was completed. ecobee refresh tokens expire about a year after authorization. Not reported for tokens saved by older versions of the exporter.",
+			nil, nil,
+		),
+		expiryWarning: prometheus.NewDesc(
+			"ecobee_refresh_token_expiry_warning",
+			"1 if the refresh token is older than -refresh-token-warn-age and the pin flow should be run again before it expires.",
+			nil, nil,
+		),
+		scopesInfo: prometheus.NewDesc(
+			"ecobee_token_scopes_info",
+			"The scopes the current token was granted and the required scopes it is missing. Not reported for tokens saved by older versions of the exporter.",
+			[]string{"scopes", "missing"}, nil,
+		),
+	}
+}
+
+func (c *tokenCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.valid
+	ch <- c.expiry
+	ch <- c.refreshFailures
+	ch <- c.refreshSkipped
+	ch <- c.reAuthRequired
+	ch <- c.loadErrors
+	ch <- c.lastError
+	ch <- c.refreshTokenAge
+	ch <- c.expiryWarning
+	ch <- c.scopesInfo
+}
+
+func (c *tokenCollector) Collect(ch chan<- prometheus.Metric) {
+	tok := c.ts.CachedToken()
+
+	ch <- prometheus.MustNewConstMetric(c.valid, prometheus.GaugeValue, boolToFloat64(tok.Valid()))
+	if tok != nil && !tok.Expiry.IsZero() {
+		ch <- prometheus.MustNewConstMetric(c.expiry, prometheus.GaugeValue, time.Until(tok.Expiry).Seconds())
+	}
+	ch <- prometheus.MustNewConstMetric(c.refreshFailures, prometheus.CounterValue, float64(c.ts.RefreshFailures()))
+	ch <- prometheus.MustNewConstMetric(c.refreshSkipped, prometheus.CounterValue, float64(c.ts.RefreshSkipped()))
+	ch <- prometheus.MustNewConstMetric(c.reAuthRequired, prometheus.GaugeValue, boolToFloat64(c.ts.ReAuthRequired()))
+	ch <- prometheus.MustNewConstMetric(c.loadErrors, prometheus.CounterValue, float64(c.ts.LoadErrors()))
+	if reason := c.ts.LastErrorReason(); reason != "" {
+		ch <- prometheus.MustNewConstMetric(c.lastError, prometheus.GaugeValue, 1, reason)
+	}
+	if tok != nil {
+		if obtained := ecobeeauth.ObtainedAt(tok); !obtained.IsZero() {
+			age := time.Since(obtained)
+			ch <- prometheus.MustNewConstMetric(c.refreshTokenAge, prometheus.GaugeValue, age.Seconds())
+			ch <- prometheus.MustNewConstMetric(c.expiryWarning, prometheus.GaugeValue, boolToFloat64(age > c.warnAge))
+		}
+		if scopes := ecobeeauth.TokenScopes(tok); len(scopes) > 0 {
+			ch <- prometheus.MustNewConstMetric(c.scopesInfo, prometheus.GaugeValue, 1,
+				strings.Join(scopes, ","), strings.Join(c.ts.MissingScopes(), ","))
+		}
+	}
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/rfratto/ecobee_exporter/ecobeeauth"
+)
+
+// registerTokenTransferRoutes adds /auth-export and /auth-import to r, which
+// copy the ecobee token between exporters so a new deployment doesn't need
+// to run the pin flow again. The token includes the refresh token, which
+// grants indefinite access to the account, so every request must carry an
+// Authorization header with a Bearer token matching authToken.
+func registerTokenTransferRoutes(r *mux.Router, ts *ecobeeauth.TokenSource, authToken string) {
+	auth := requireBearer(authToken)
+
+	// /auth-export responds with the current token as JSON.
+	r.Handle("/auth-export", auth(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		tok := ts.CachedToken()
+		if tok == nil {
+			http.Error(rw, "no ecobee token available", http.StatusNotFound)
+			return
+		}
+
+		rw.Header().Set("Content-Type", "application/json")
+		rw.Header().Set("Cache-Control", "no-store")
+		_ = ecobeeauth.EncodeToken(rw, tok)
+	}))).Methods(http.MethodGet)
+
+	// /auth-import saves a token in the format returned by /auth-export.
+	r.Handle("/auth-import", auth(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		tok, err := ecobeeauth.DecodeToken(http.MaxBytesReader(rw, r.Body, 1<<20))
+		if err != nil {
+			http.Error(rw, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if tok.AccessToken == "" || tok.RefreshToken == "" {
+			http.Error(rw, "token must have an access_token and refresh_token", http.StatusBadRequest)
+			return
+		}
+
+		if err := ts.SaveToken(tok); err != nil {
+			http.Error(rw, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		rw.WriteHeader(http.StatusOK)
+	}))).Methods(http.MethodPost)
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rfratto/ecobee_exporter/ecobeeauth"
+)
+
+// tokenTransport is an http.RoundTripper that authenticates requests with
+// the token from a TokenSource. Unlike oauth2.Transport, refreshing the
+// token uses the context of the request, so a canceled scrape doesn't wait
+// for the refresh to finish.
+type tokenTransport struct {
+	ts   *ecobeeauth.TokenSource
+	base http.RoundTripper
+}
+
+func (t *tokenTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	tok, err := t.ts.TokenWithContext(req.Context())
+	if err != nil {
+		return nil, err
+	}
+
+	// RoundTrippers must not modify the original request.
+	req = req.Clone(req.Context())
+	tok.SetAuthHeader(req)
+	return t.base.RoundTrip(req)
+}
+
+// defaultRetryAfter is how long to back off after a 429 that doesn't specify
+// a Retry-After.
+const defaultRetryAfter = time.Minute
+
+// errRateLimited is returned by rateLimitTransport for requests made while
+// backing off from a 429.
+var errRateLimited = errors.New("rate limited by ecobee, backing off")
+
+// localLimitWindow is the window that requests are counted over when
+// tracking the rate limit locally.
+const localLimitWindow = time.Hour
+
+// rateLimitTransport is an http.RoundTripper that watches for 429 responses
+// from the ecobee API. After a 429, requests fail with errRateLimited
+// without being sent until the Retry-After window has passed.
+//
+// It also tracks how close the exporter is to being rate limited, either
+// from rate limit headers in responses or, if ecobee doesn't send any, by
+// counting requests against localLimit.
+type rateLimitTransport struct {
+	base       http.RoundTripper
+	localLimit int
+
+	mut   sync.Mutex
+	until time.Time
+
+	// Values of the most recent rate limit headers, if any were sent.
+	haveHeaders       bool
+	headerLimit       float64
+	headerRemaining   float64
+	recentRequestTime []time.Time
+}
+
+// newRateLimitTransport creates a new rateLimitTransport. localLimit is the
+// number of requests per hour ecobee is expected to allow; 0 disables
+// tracking the rate limit locally.
+func newRateLimitTransport(base http.RoundTripper, localLimit int) *rateLimitTransport {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	return &rateLimitTransport{base: base, localLimit: localLimit}
+}
+
+func (t *rateLimitTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if t.limited() {
+		return nil, errRateLimited
+	}
+	t.recordRequest(time.Now())
+
+	resp, err := t.base.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	t.recordHeaders(resp.Header)
+
+	if resp.StatusCode == http.StatusTooManyRequests {
+		wait := parseRetryAfter(resp.Header.Get("Retry-After"), time.Now())
+
+		t.mut.Lock()
+		t.until = time.Now().Add(wait)
+		t.mut.Unlock()
+	}
+	return resp, nil
+}
+
+// limited returns true while backing off from a 429.
+func (t *rateLimitTransport) limited() bool {
+	t.mut.Lock()
+	defer t.mut.Unlock()
+	return time.Now().Before(t.until)
+}
+
+func (t *rateLimitTransport) recordRequest(now time.Time) {
+	if t.localLimit <= 0 {
+		return
+	}
+
+	t.mut.Lock()
+	defer t.mut.Unlock()
+	t.recentRequestTime = append(t.pruneRequests(now), now)
+}
+
+// pruneRequests removes requests older than localLimitWindow. t.mut must be
+// held.
+func (t *rateLimitTransport) pruneRequests(now time.Time) []time.Time {
+	cutoff := now.Add(-localLimitWindow)
+	i := 0
+	for i < len(t.recentRequestTime) && t.recentRequestTime[i].Before(cutoff) {
+		i++
+	}
+	t.recentRequestTime = t.recentRequestTime[i:]
+	return t.recentRequestTime
+}
+
+// recordHeaders saves rate limit headers from a response. Both the common
+// X-RateLimit-* headers and the draft standard RateLimit-* headers are
+// recognized.
+func (t *rateLimitTransport) recordHeaders(h http.Header) {
+	limit, limitErr := parseHeaderFloat(h, "X-RateLimit-Limit", "RateLimit-Limit")
+	remaining, remainingErr := parseHeaderFloat(h, "X-RateLimit-Remaining", "RateLimit-Remaining")
+	if limitErr != nil || remainingErr != nil {
+		return
+	}
+
+	t.mut.Lock()
+	defer t.mut.Unlock()
+	t.haveHeaders = true
+	t.headerLimit = limit
+	t.headerRemaining = remaining
+}
+
+func parseHeaderFloat(h http.Header, names ...string) (float64, error) {
+	for _, name := range names {
+		if v := h.Get(name); v != "" {
+			return strconv.ParseFloat(v, 64)
+		}
+	}
+	return 0, errors.New("header not present")
+}
+
+// quota returns the request limit and the number of requests remaining. ok
+// is false if ecobee hasn't sent rate limit headers and local tracking is
+// disabled.
+func (t *rateLimitTransport) quota() (limit, remaining float64, ok bool) {
+	t.mut.Lock()
+	defer t.mut.Unlock()
+
+	if t.haveHeaders {
+		return t.headerLimit, t.headerRemaining, true
+	} else if t.localLimit > 0 {
+		used := len(t.pruneRequests(time.Now()))
+		return float64(t.localLimit), float64(t.localLimit - used), true
+	}
+	return 0, 0, false
+}
+
+// parseRetryAfter parses the value of a Retry-After header, which is either
+// a number of seconds or an HTTP date.
+func parseRetryAfter(v string, now time.Time) time.Duration {
+	if secs, err := strconv.Atoi(v); err == nil && secs > 0 {
+		return time.Duration(secs) * time.Second
+	}
+	if at, err := http.ParseTime(v); err == nil && at.After(now) {
+		return at.Sub(now)
+	}
+	return defaultRetryAfter
+}
+
+// maintenanceTransport is an http.RoundTripper that detects when the ecobee
+// API is down for planned maintenance. During the window, ecobee responds
+// with a server error whose status message mentions maintenance. Other
+// server errors, like a bare 503 from a load balancer, are failures and
+// don't start a window. The window is considered over once a request
+// succeeds.
+type maintenanceTransport struct {
+	base http.RoundTripper
+
+	mut    sync.Mutex
+	active bool
+}
+
+func newMaintenanceTransport(base http.RoundTripper) *maintenanceTransport {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	return &maintenanceTransport{base: base}
+}
+
+func (t *maintenanceTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.base.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case resp.StatusCode < 300:
+		t.set(false)
+	case resp.StatusCode >= 500:
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		// Callers still need to read the body.
+		resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+		t.set(isMaintenanceBody(body))
+	}
+	return resp, nil
+}
+
+// isMaintenanceBody returns true if body is an ecobee error response whose
+// status message mentions maintenance.
+func isMaintenanceBody(body []byte) bool {
+	var r struct {
+		Status struct {
+			Message string `json:"message"`
+		} `json:"status"`
+	}
+	if err := json.Unmarshal(body, &r); err != nil {
+		return false
+	}
+	return strings.Contains(strings.ToLower(r.Status.Message), "maintenance")
+}
+
+func (t *maintenanceTransport) set(active bool) {
+	t.mut.Lock()
+	defer t.mut.Unlock()
+	t.active = active
+}
+
+// inMaintenance returns true if the last response from ecobee indicated
+// the API is down for maintenance.
+func (t *maintenanceTransport) inMaintenance() bool {
+	t.mut.Lock()
+	defer t.mut.Unlock()
+	return t.active
+}
+
+// bodyLimitTransport is an http.RoundTripper that fails reading response
+// bodies larger than max bytes with ecobeeauth.ErrResponseTooLarge, so a
+// misbehaving endpoint can't exhaust the exporter's memory.
+type bodyLimitTransport struct {
+	base http.RoundTripper
+	max  int64
+}
+
+func (t *bodyLimitTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.base.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = ecobeeauth.LimitBody(resp.Body, t.max)
+	return resp, nil
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) { return f(req) }
+
+func TestMaintenanceTransport(t *testing.T) {
+	tt := []struct {
+		name   string
+		status int
+		body   string
+		want   bool
+	}{
+		{"success", http.StatusOK, `{"status": {"code": 0, "message": ""}}`, false},
+		{"maintenance", http.StatusInternalServerError, `{"status": {"code": 3, "message": "The API is down for scheduled maintenance."}}`, true},
+		{"maintenance 503", http.StatusServiceUnavailable, `{"status": {"code": 3, "message": "Scheduled maintenance"}}`, true},
+		{"bare 503", http.StatusServiceUnavailable, `<html>Service Unavailable</html>`, false},
+		{"other error", http.StatusInternalServerError, `{"status": {"code": 3, "message": "Processing error."}}`, false},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			mt := newMaintenanceTransport(roundTripFunc(func(req *http.Request) (*http.Response, error) {
+				return &http.Response{
+					StatusCode: tc.status,
+					Body:       ioutil.NopCloser(strings.NewReader(tc.body)),
+					Request:    req,
+				}, nil
+			}))
+			req, _ := http.NewRequest(http.MethodGet, "https://api.ecobee.com/1/thermostat", nil)
+			resp, err := mt.RoundTrip(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// The body must still be readable by the caller.
+			body, _ := ioutil.ReadAll(resp.Body)
+			if string(body) != tc.body {
+				t.Errorf("body = %q, want %q", body, tc.body)
+			}
+			if got := mt.inMaintenance(); got != tc.want {
+				t.Errorf("inMaintenance() = %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
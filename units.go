@@ -0,0 +1,98 @@
+package main
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// temperatureUnit is the unit temperature metrics are reported in.
+type temperatureUnit string
+
+const (
+	unitFahrenheit temperatureUnit = "fahrenheit"
+	unitCelsius    temperatureUnit = "celsius"
+
+	// unitBoth reports every temperature in both units, distinguished by a
+	// "unit" label. This doubles the number of temperature series.
+	unitBoth temperatureUnit = "both"
+)
+
+func parseTemperatureUnit(s string) (temperatureUnit, error) {
+	switch u := temperatureUnit(s); u {
+	case unitFahrenheit, unitCelsius, unitBoth:
+		return u, nil
+	default:
+		return "", fmt.Errorf("unknown temperature unit %q, must be one of fahrenheit, celsius, both", s)
+	}
+}
+
+// temperatureFormat is how temperature metrics are reported.
+type temperatureFormat struct {
+	unit temperatureUnit
+
+	// precision is the number of decimal places to round to. Negative values
+	// disable rounding.
+	precision int
+}
+
+// round rounds v to the configured precision. Converting between units
+// leaves long fractions like 21.77777777777778, which clutter tables and
+// make exact comparisons unreliable.
+func (tf temperatureFormat) round(v float64) float64 {
+	if tf.precision < 0 {
+		return v
+	}
+	scale := math.Pow(10, float64(tf.precision))
+	return math.Round(v*scale) / scale
+}
+
+// temperatureDesc describes a temperature metric that is reported in the
+// configured temperature format.
+type temperatureDesc struct {
+	desc *prometheus.Desc
+	temperatureFormat
+
+	// delta is true if the metric is a difference between two temperatures
+	// rather than an absolute temperature.
+	delta bool
+}
+
+// newTemperatureDesc creates a new temperatureDesc. labels are the variable
+// labels of the metric, not including the unit label.
+func newTemperatureDesc(name, help string, tf temperatureFormat, delta bool, constLabels prometheus.Labels, labels ...string) *temperatureDesc {
+	if tf.unit == unitBoth {
+		labels = append(labels[:len(labels):len(labels)], "unit")
+	}
+	return &temperatureDesc{
+		desc:              prometheus.NewDesc(name, help, labels, constLabels),
+		temperatureFormat: tf,
+		delta:             delta,
+	}
+}
+
+// collect emits the metric for a temperature reported by ecobee, which
+// always reports temperatures in tenths of a degree Fahrenheit.
+// labelValues are the values of the labels passed to newTemperatureDesc.
+func (td *temperatureDesc) collect(ch chan<- prometheus.Metric, tenths int, labelValues ...string) {
+	f := float64(tenths) / 10.0
+
+	switch td.unit {
+	case unitFahrenheit:
+		ch <- prometheus.MustNewConstMetric(td.desc, prometheus.GaugeValue, td.round(f), labelValues...)
+	case unitCelsius:
+		ch <- prometheus.MustNewConstMetric(td.desc, prometheus.GaugeValue, td.round(td.celsius(f)), labelValues...)
+	case unitBoth:
+		n := len(labelValues)
+		ch <- prometheus.MustNewConstMetric(td.desc, prometheus.GaugeValue, td.round(f), append(labelValues[:n:n], string(unitFahrenheit))...)
+		ch <- prometheus.MustNewConstMetric(td.desc, prometheus.GaugeValue, td.round(td.celsius(f)), append(labelValues[:n:n], string(unitCelsius))...)
+	}
+}
+
+func (td *temperatureDesc) celsius(f float64) float64 {
+	if td.delta {
+		return f * 5 / 9
+	}
+	return (f - 32) * 5 / 9
+}
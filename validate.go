@@ -0,0 +1,47 @@
+package main
+
+import (
+	"fmt"
+	"io"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/rfratto/ecobee_exporter/ecobeeauth"
+)
+
+// validate checks that the exporter is usable by performing a single scrape
+// against a temporary registry. The resulting metrics are written to w in
+// the Prometheus text format. An error is returned if there is no token or
+// any thermostat couldn't be retrieved.
+func validate(w io.Writer, ts *ecobeeauth.TokenSource, exporters *exporterSet) error {
+	if ts.CachedToken() == nil {
+		return fmt.Errorf("no ecobee token available, run the /auth-start flow first")
+	}
+
+	mfs, err := scrapeOnce(w, exporters)
+	if err != nil {
+		return err
+	}
+
+	for _, mf := range mfs {
+		if mf.GetName() != "ecobee_up" {
+			continue
+		}
+		for _, m := range mf.GetMetric() {
+			if m.GetGauge().GetValue() != 1 {
+				return fmt.Errorf("failed to retrieve thermostat %s from the ecobee API", labelValue(m, "thermostat_id"))
+			}
+		}
+	}
+	return nil
+}
+
+// labelValue returns the value of the label name of m, or an empty string
+// if m doesn't have it.
+func labelValue(m *dto.Metric, name string) string {
+	for _, lp := range m.GetLabel() {
+		if lp.GetName() == name {
+			return lp.GetValue()
+		}
+	}
+	return ""
+}